@@ -1,14 +1,21 @@
 package agent
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	UUID "github.com/google/uuid"
 )
 
@@ -17,22 +24,51 @@ type Agent interface {
 	IsConnected() bool
 	Connect() error
 	Disconnect()
+	ConnectContext(ctx context.Context) error
+	DisconnectContext(ctx context.Context) error
 	SetOnConnectHandler(onConn OnConnectHandler)
 	SetOnDisconnectHandler(onDisconn OnDisconnectHandler)
 	SetOnMessageReceiveHandler(onMessageReceive OnMessageReceiveHandler)
 	UploadConfig(action byte, edgeConfig EdgeConfig) bool
 	SendDeviceStatus(status EdgeDeviceStatus) bool
 	SendData(data EdgeData) bool
+	UploadConfigE(action byte, edgeConfig EdgeConfig) error
+	SendDeviceStatusE(status EdgeDeviceStatus) error
+	SendDataE(data EdgeData) (SendResult, error)
+	UploadConfigContext(ctx context.Context, action byte, edgeConfig EdgeConfig) error
+	SendDeviceStatusContext(ctx context.Context, status EdgeDeviceStatus) error
+	SendDataContext(ctx context.Context, data EdgeData) (SendResult, error)
+	UploadConfigAndWait(ctx context.Context, action byte, edgeConfig EdgeConfig) error
+	DiffConfig(edgeConfig EdgeConfig) (ConfigDiff, error)
+	SyncConfig(ctx context.Context, edgeConfig EdgeConfig, dryRun bool) (ConfigDiff, error)
+	UploadConfigIfChanged(ctx context.Context, action byte, edgeConfig EdgeConfig) (bool, error)
+	ExportConfig(w io.Writer, format string) error
+	SetDeadband(deviceID string, tagName string, options DeadbandOptions)
+	Flush(ctx context.Context) error
 }
 
 // Agent ...
 type agent struct {
 	options           EdgeAgentOptions
-	client            MQTT.Client // interface
+	transport         Transport
+	clientLock        sync.RWMutex // guards client and the timers
+	client            Transport
 	heartbeatTimer    chan bool
 	dataRecoverTimer  chan bool
 	dataRecoverHelper DataRecoverHelper
 	cfgCache          configMessage
+	cfgLock           sync.RWMutex
+	cfgFingerprint    string
+	logger            Logger
+	recovering        int32
+	tagsCfgFilePath   string
+	uploadLock        sync.Mutex
+	ackLock           sync.Mutex
+	ackWaiter         chan bool
+	deadbandLock      sync.Mutex
+	deadbands         map[string]DeadbandOptions
+	sentValues        map[string]sentValue
+	async             *asyncQueue
 	OnConnect         OnConnectHandler
 	OnDisconnect      OnDisconnectHandler
 	OnMessageReceive  OnMessageReceiveHandler
@@ -51,6 +87,7 @@ type OnMessageReceiveHandler func(MessageReceivedEventArgs)
 func NewAgent(options *EdgeAgentOptions) Agent {
 	a := &agent{
 		options:           *options,
+		transport:         options.Transport,
 		client:            nil,
 		heartbeatTimer:    nil,
 		dataRecoverTimer:  nil,
@@ -60,27 +97,125 @@ func NewAgent(options *EdgeAgentOptions) Agent {
 		OnDisconnect:      func(a Agent) {},
 		OnMessageReceive:  func(res MessageReceivedEventArgs) {},
 	}
+	if a.transport == nil {
+		a.transport = NewPahoTransport()
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = defaultLogger()
+	}
+	a.logger = withFields(logger, "nodeID", options.NodeID)
+	if a.options.FileMode == 0 {
+		a.options.FileMode = defaultFileMode
+	}
+	if a.options.DirMode == 0 {
+		a.options.DirMode = defaultDirMode
+	}
+	a.tagsCfgFilePath = a.statePath(options.TagsCfgFilePath, tagsCfgFilePath)
+
 	if options.DataRecover {
-		a.dataRecoverHelper = NewDataRecoverHelper(dataRecoverFilePath)
+		limits := options.DataRecoverLimits
+		recoverType := options.DataRecoverType
+		if options.DataRecoverHelper == nil && !cgoEnabled &&
+			recoverType != DataRecoverType["File"] && recoverType != DataRecoverType["Memory"] {
+			a.logger.Warn("SQLite needs cgo, recover data is stored in a file journal")
+			recoverType = DataRecoverType["File"]
+		}
+		switch {
+		case options.DataRecoverHelper != nil:
+			a.dataRecoverHelper = options.DataRecoverHelper
+		case recoverType == DataRecoverType["File"]:
+			helper := newFileDataRecoverHelper(a.statePath(options.DataRecoverFilePath, dataRecoverJournalPath), limits, a.logger)
+			helper.fileMode = a.options.FileMode
+			helper.dirMode = a.options.DirMode
+			a.dataRecoverHelper = helper
+		case recoverType == DataRecoverType["Memory"]:
+			a.dataRecoverHelper = newMemoryDataRecoverHelper(limits, a.logger)
+		default:
+			helper := newDataRecoverHelper(a.statePath(options.DataRecoverFilePath, dataRecoverFilePath), limits, a.logger)
+			helper.fileMode = a.options.FileMode
+			helper.dirMode = a.options.DirMode
+			a.dataRecoverHelper = helper
+		}
+	}
+
+	if options.Async != nil {
+		a.async = newAsyncQueue(a, *options.Async)
 	}
 
 	// add cfg to memory from disk
 	helper := newTagsCfgHelper()
-	helper.getCfgFromFile(a, tagsCfgFilePath)
+	helper.getCfgFromFile(a, a.tagsCfgFilePath)
+	helper.getFingerprintFromFile(a, a.tagsCfgFilePath+tagsCfgFingerprintSuffix)
 
 	return a
 }
 
+// statePath returns path when set, otherwise name in the state directory
+// StateDir/NodeID, StateDir/NodeID/DeviceID for devices. A file left in the
+// working directory by earlier versions is moved there, when that fails it
+// keeps being used. The directory is created when the file is first written.
+func (a *agent) statePath(path string, name string) string {
+	if path != "" {
+		return path
+	}
+	dir := filepath.Join(a.options.StateDir, a.options.NodeID)
+	if a.options.Type == EdgeType["Device"] {
+		dir = filepath.Join(dir, a.options.DeviceID)
+	}
+	path = filepath.Join(dir, name)
+	if _, err := os.Stat(name); err != nil {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	err := os.MkdirAll(dir, a.options.DirMode)
+	if err == nil {
+		err = os.Rename(name, path)
+	}
+	if err != nil {
+		a.logger.Warn("move legacy state file failed, it stays in use", "path", name, "error", err)
+		return name
+	}
+	a.logger.Info("legacy state file moved", "from", name, "to", path)
+	return path
+}
+
+// writeStateFile writes a file of the state directory, creating the
+// directory when needed.
+func (a *agent) writeStateFile(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), a.options.DirMode); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, a.options.FileMode)
+}
+
 // IsConnected ...
 func (a *agent) IsConnected() bool {
-	if a.client == nil {
+	client := a.getClient()
+	if client == nil {
 		return false
 	}
-	return a.client.IsConnectionOpen()
+	return client.IsConnected()
+}
+
+// getClient returns the connected transport, nil after Disconnect.
+func (a *agent) getClient() Transport {
+	a.clientLock.RLock()
+	defer a.clientLock.RUnlock()
+	return a.client
 }
 
 // Connect ...
 func (a *agent) Connect() error {
+	return a.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to the broker, fetching the credential from DCCS
+// first when needed. If ctx is done before the broker accepts the
+// connection, the connection attempt is aborted and ctx.Err() is returned.
+func (a *agent) ConnectContext(ctx context.Context) error {
 
 	if a.IsConnected() {
 		return nil
@@ -89,9 +224,9 @@ func (a *agent) Connect() error {
 		if !a.options.DCCS.isValid() {
 			return errors.New("DCCS options is invalid")
 		}
-		error := a.getCredentailFromDCCS()
+		error := a.getCredentailFromDCCS(ctx)
 		if error != nil {
-			fmt.Println(error)
+			a.logger.Error("get credential from DCCS failed", "error", error)
 			return error
 		}
 	}
@@ -99,78 +234,248 @@ func (a *agent) Connect() error {
 		return errors.New("MQTT options is invalid")
 	}
 
-	clientOptions, _ := a.newClientOptions()
-	a.client = MQTT.NewClient(clientOptions)
-	if token := a.client.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
+	transportOptions, err := a.newTransportOptions()
+	if err != nil {
+		return err
+	}
+	client := a.transport
+	a.clientLock.Lock()
+	a.client = client
+	a.clientLock.Unlock()
+	if err := waitToken(ctx, client.Connect(transportOptions)); err != nil {
+		if ctx.Err() != nil {
+			client.Disconnect(0)
+		}
+		return err
 	}
+	a.async.start(client)
 	return nil
 }
 
 // Disconnect ...
 func (a *agent) Disconnect() {
-	if !a.client.IsConnected() {
-		return
+	a.DisconnectContext(context.Background())
+}
+
+// DisconnectContext sends the disconnect message and closes the connection.
+// The connection is closed even if ctx is done before the disconnect
+// message is confirmed, in which case ctx.Err() is returned.
+func (a *agent) DisconnectContext(ctx context.Context) error {
+	client := a.getClient()
+	if client == nil {
+		return a.async.close(ctx)
 	}
 
-	/* Send Disconnect message */
-	topic := fmt.Sprintf(mqttTopic["DeviceConnTopic"], a.options.NodeID, a.options.DeviceID)
-	if a.options.Type == EdgeType["GateWay"] {
-		topic = fmt.Sprintf(mqttTopic["NodeConnTopic"], a.options.NodeID)
+	// publish the queued data while still connected, then stop the worker
+	err := a.Flush(ctx)
+	if closeErr := a.async.close(ctx); err == nil {
+		err = closeErr
 	}
-	payload := newDisconnectMessage().getPayload()
-	if token := a.client.Publish(topic, mqttQoS["AtLeastOnce"], true, payload); token.Wait() && token.Error() != nil {
-		fmt.Println("token error in Disconnect: ", token.Error())
+
+	/* Send Disconnect message */
+	if client.IsConnected() {
+		topic := fmt.Sprintf(mqttTopic["DeviceConnTopic"], a.options.NodeID, a.options.DeviceID)
+		if a.options.Type == EdgeType["GateWay"] {
+			topic = fmt.Sprintf(mqttTopic["NodeConnTopic"], a.options.NodeID)
+		}
+		payload := newDisconnectMessage().getPayload()
+		if publishErr := a.publish(ctx, topic, true, payload); err == nil {
+			err = publishErr
+		}
 	}
 
-	go a.handleDisconnect()
-	a.client.Disconnect(0)
+	client.Disconnect(0)
+	a.handleDisconnect()
+	return err
 }
 
 func (a *agent) UploadConfig(action byte, config EdgeConfig) bool {
+	return a.UploadConfigE(action, config) == nil
+}
+
+// UploadConfigE is UploadConfig returning the reason of a failure.
+func (a *agent) UploadConfigE(action byte, config EdgeConfig) error {
+	return a.UploadConfigContext(context.Background(), action, config)
+}
+
+// UploadConfigContext is UploadConfigE honouring the cancellation of ctx.
+func (a *agent) UploadConfigContext(ctx context.Context, action byte, config EdgeConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if !a.IsConnected() {
-		return false
+		return ErrNotConnected
+	}
+	payload, err := a.convertConfig(action, config)
+	if err != nil {
+		return err
 	}
+	if err := a.publishConfig(ctx, payload); err != nil {
+		return err
+	}
+	a.applyConfig(payload)
+	return nil
+}
+
+// publishConfig publishes a config message, the fingerprint is cleared
+// first as DataHub has not acked the config yet.
+func (a *agent) publishConfig(ctx context.Context, payload configMessage) error {
+	a.clearCfgFingerprint()
+	topic := fmt.Sprintf(mqttTopic["ConfigTopic"], a.options.NodeID)
+	return a.publish(ctx, topic, true, payload.getPayload())
+}
+
+// applyConfig merges a config DataHub received into the config cache and
+// writes the cache file.
+func (a *agent) applyConfig(payload configMessage) {
+	helper := newTagsCfgHelper()
+
+	// apply config to memory
+	helper.addCfgToMemory(a, payload)
+
+	// write config to disk
+	helper.addCfgToFile(a, a.tagsCfgFilePath)
+}
+
+func (a *agent) convertConfig(action byte, config EdgeConfig) (configMessage, error) {
 	nodeID := a.options.NodeID
 
 	var payload configMessage
-	var result = false
+	if err := config.Validate(); err != nil {
+		return payload, err
+	}
 	switch action {
 	case Action["Create"]:
-		result, payload = convertCreateorUpdateConfig(action, nodeID, config, a.options.HeartBeatInterval)
+		_, payload = convertCreateorUpdateConfig(action, nodeID, config, a.options.HeartBeatInterval)
 	case Action["Update"]:
-		result, payload = convertCreateorUpdateConfig(action, nodeID, config, a.options.HeartBeatInterval)
+		_, payload = convertCreateorUpdateConfig(action, nodeID, config, a.options.HeartBeatInterval)
 	case Action["Delete"]:
-		result, payload = convertDeleteConfig(action, nodeID, config)
+		_, payload = convertDeleteConfig(action, nodeID, config)
 	case Action["Delsert"]:
-		result, payload = convertCreateorUpdateConfig(action, nodeID, config, a.options.HeartBeatInterval)
+		_, payload = convertCreateorUpdateConfig(action, nodeID, config, a.options.HeartBeatInterval)
 	default:
-		result = false
+		return payload, fmt.Errorf("%w: unknown action %d", ErrInvalidConfig, action)
 	}
+	return payload, nil
+}
 
-	if action != Action["Delete"] {
-		helper := newTagsCfgHelper()
+func (a *agent) clearCfgFingerprint() {
+	a.cfgLock.RLock()
+	fingerprint := a.cfgFingerprint
+	a.cfgLock.RUnlock()
+	if fingerprint != "" {
+		newTagsCfgHelper().addFingerprintToFile(a, a.tagsCfgFilePath+tagsCfgFingerprintSuffix, "")
+	}
+}
 
-		// add config to memory
-		helper.addCfgToMemory(a, payload)
+// UploadConfigIfChanged is UploadConfigAndWait skipping the upload when the
+// same action and config were the last ones acknowledged by DataHub, e.g.
+// when it is called in every OnConnect. It reports whether it uploaded.
+func (a *agent) UploadConfigIfChanged(ctx context.Context, action byte, config EdgeConfig) (bool, error) {
+	payload, err := a.convertConfig(action, config)
+	if err != nil {
+		return false, err
+	}
+	fingerprint := configFingerprint(payload)
+
+	a.cfgLock.RLock()
+	unchanged := fingerprint != "" && fingerprint == a.cfgFingerprint
+	a.cfgLock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	return true, a.UploadConfigAndWait(ctx, action, config)
+}
+
+// UploadConfigAndWait uploads the config and waits for the ConfigAck of
+// DataHub. When no ack arrives within ConfigAckTimeout the upload is retried
+// ConfigAckRetry times. The ack is still passed to OnMessageReceive.
+func (a *agent) UploadConfigAndWait(ctx context.Context, action byte, config EdgeConfig) error {
+	payload, err := a.convertConfig(action, config)
+	if err != nil {
+		return err
+	}
 
-		// write config to disk
-		helper.addCfgToFile(a, tagsCfgFilePath)
+	// DataHub acks carry no id, so only one upload may wait at a time
+	a.uploadLock.Lock()
+	defer a.uploadLock.Unlock()
+	if err := a.uploadConfigAndWait(ctx, payload); err != nil {
+		return err
 	}
+	newTagsCfgHelper().addFingerprintToFile(a, a.tagsCfgFilePath+tagsCfgFingerprintSuffix, configFingerprint(payload))
+	return nil
+}
 
-	if result {
-		topic := fmt.Sprintf(mqttTopic["ConfigTopic"], a.options.NodeID)
-		if token := a.client.Publish(topic, mqttQoS["AtLeastOnce"], true, payload.getPayload()); token.Wait() && token.Error() != nil {
-			fmt.Println("token error in UploadConfig: ", token.Error())
-			result = false
+// uploadConfigAndWait publishes payload until DataHub acks it and applies
+// it to the config cache when the ack is positive, the caller must hold
+// uploadLock.
+func (a *agent) uploadConfigAndWait(ctx context.Context, payload configMessage) error {
+	timeout := time.Duration(a.options.ConfigAckTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(defaultConfigAckTimeout) * time.Second
+	}
+	attempts := a.options.ConfigAckRetry + 1
+	if attempts < 1 {
+		attempts = 1
+	}
+	for i := 0; i < attempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !a.IsConnected() {
+			return ErrNotConnected
+		}
+		ack := make(chan bool, 1)
+		a.setAckWaiter(ack)
+		if err := a.publishConfig(ctx, payload); err != nil {
+			a.setAckWaiter(nil)
+			return err
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case result := <-ack:
+			timer.Stop()
+			a.setAckWaiter(nil)
+			if !result {
+				return ErrConfigRejected
+			}
+			a.applyConfig(payload)
+			return nil
+		case <-timer.C:
+			a.setAckWaiter(nil)
+			a.logger.Warn("config ack timeout", "attempt", i+1, "timeout", timeout)
+		case <-ctx.Done():
+			timer.Stop()
+			a.setAckWaiter(nil)
+			return ctx.Err()
 		}
 	}
-	return result
+	return fmt.Errorf("%w: no ack after %d attempts of %s", ErrConfigAckTimeout, attempts, timeout)
+}
+
+func (a *agent) setAckWaiter(ack chan bool) {
+	a.ackLock.Lock()
+	defer a.ackLock.Unlock()
+	a.ackWaiter = ack
 }
 
 func (a *agent) SendDeviceStatus(statuses EdgeDeviceStatus) bool {
+	return a.SendDeviceStatusE(statuses) == nil
+}
+
+// SendDeviceStatusE is SendDeviceStatus returning the reason of a failure.
+func (a *agent) SendDeviceStatusE(statuses EdgeDeviceStatus) error {
+	return a.SendDeviceStatusContext(context.Background(), statuses)
+}
+
+// SendDeviceStatusContext is SendDeviceStatusE honouring the cancellation of ctx.
+func (a *agent) SendDeviceStatusContext(ctx context.Context, statuses EdgeDeviceStatus) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if !(a.IsConnected()) {
-		return false
+		return ErrNotConnected
 	}
 	msg := newStatusMessage()
 	msg.Ts = statuses.Timestamp.Format(time.RFC3339)
@@ -179,47 +484,178 @@ func (a *agent) SendDeviceStatus(statuses EdgeDeviceStatus) bool {
 	}
 	payload := msg.getPayload()
 	topic := fmt.Sprintf(mqttTopic["NodeConnTopic"], a.options.NodeID)
-	if token := a.client.Publish(topic, mqttQoS["AtLeastOnce"], true, payload); token.Wait() && token.Error() != nil {
-		fmt.Println("token error in SendDviceStatus: ", token.Error())
-		return false
-	}
-	return true
+	return a.publish(ctx, topic, true, payload)
 }
 
 func (a *agent) SendData(data EdgeData) bool {
-	result, payloads := convertTagValue(data, a)
-	topic := fmt.Sprintf(mqttTopic["DataTopic"], a.options.NodeID)
-	if !a.IsConnected() {
-		for _, payload := range payloads {
-			if a.dataRecoverHelper != nil {
-				a.dataRecoverHelper.Write(payload)
-			}
+	_, err := a.SendDataE(data)
+	return err == nil
+}
+
+// SendDataE is SendData returning how the payloads were handled. Payloads
+// which could not be published are spooled to the DataRecoverHelper when
+// DataRecover is enabled, the returned error is the first failure.
+func (a *agent) SendDataE(data EdgeData) (SendResult, error) {
+	return a.SendDataContext(context.Background(), data)
+}
+
+// SendDataContext is SendDataE honouring the cancellation of ctx. Payloads
+// not yet published when ctx is done are spooled like failed ones.
+func (a *agent) SendDataContext(ctx context.Context, data EdgeData) (SendResult, error) {
+	var result SendResult
+	if a.options.DataValidation != DataValidation["None"] {
+		var invalid TagValueErrors
+		var valid bool
+		data, invalid, valid = a.validateData(data)
+		result.Invalid = len(invalid)
+		if !valid {
+			return result, invalid
 		}
-		result = false
-	} else {
-		for _, payload := range payloads {
-			if token := a.client.Publish(topic, mqttQoS["AtLeastOnce"], true, payload); token.Wait() && token.Error() != nil {
-				fmt.Println("token error in SendData: ", token.Error())
-				if a.dataRecoverHelper != nil {
-					a.dataRecoverHelper.Write(payload)
-				}
-				result = false
+	}
+	if len(data.TagList) > 0 {
+		data, result.Skipped = a.filterDeadband(data)
+		if len(data.TagList) == 0 {
+			return result, nil
+		}
+	}
+	if a.async != nil {
+		return a.async.enqueue(ctx, data, result)
+	}
+
+	client := a.getClient()
+	batches := groupByTimestamp([]EdgeData{data})
+	if len(batches) == 0 {
+		return a.publishData(ctx, client, data, result)
+	}
+	var firstErr error
+	for _, batch := range batches {
+		var err error
+		result, err = a.publishData(ctx, client, batch, result)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return result, firstErr
+}
+
+// groupByTimestamp merges the tag values of items into one EdgeData per
+// sample time, EdgeTag.Timestamp or else EdgeData.Timestamp, sorted by time.
+func groupByTimestamp(items []EdgeData) []EdgeData {
+	var batches []EdgeData
+	index := make(map[int64]int)
+	for _, data := range items {
+		for _, tag := range data.TagList {
+			ts := data.Timestamp
+			if !tag.Timestamp.IsZero() {
+				ts = tag.Timestamp
+			}
+			i, ok := index[ts.UnixNano()]
+			if !ok {
+				i = len(batches)
+				index[ts.UnixNano()] = i
+				batches = append(batches, EdgeData{Timestamp: ts})
 			}
+			batches[i].TagList = append(batches[i].TagList, tag)
+		}
+	}
+	sort.SliceStable(batches, func(i, j int) bool {
+		return batches[i].Timestamp.Before(batches[j].Timestamp)
+	})
+	return batches
+}
+
+// publishData publishes the payloads of data with client, spooling the
+// failed ones.
+func (a *agent) publishData(ctx context.Context, client Transport, data EdgeData, result SendResult) (SendResult, error) {
+	var firstErr error
+	dropped := result.Dropped
+	payloads, rejected := convertTagValue(data, a)
+	if len(rejected) > 0 {
+		firstErr = rejected[0]
+		result.Rejected += len(rejected)
+	}
+	topic := fmt.Sprintf(mqttTopic["DataTopic"], a.options.NodeID)
+	for _, payload := range payloads {
+		err := ctx.Err()
+		if err == nil && (client == nil || !client.IsConnected()) {
+			err = ErrNotConnected
+		}
+		if err == nil {
+			err = a.publishTo(ctx, client, topic, true, payload)
+		}
+		if err == nil {
+			result.Published++
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if a.dataRecoverHelper != nil && a.dataRecoverHelper.Write(payload) {
+			result.Spooled++
+		} else {
+			result.Dropped++
+		}
+	}
+	if result.Dropped > dropped || len(rejected) > 0 {
+		a.forgetSent(data.TagList)
+	}
+	return result, firstErr
+}
+
+// publish sends payload with QoS AtLeastOnce and waits for the broker
+// until ctx is done.
+func (a *agent) publish(ctx context.Context, topic string, retained bool, payload string) error {
+	return a.publishTo(ctx, a.getClient(), topic, retained, payload)
+}
+
+// publishTo is publish with the given client.
+func (a *agent) publishTo(ctx context.Context, client Transport, topic string, retained bool, payload string) error {
+	if client == nil {
+		return ErrNotConnected
+	}
+	if err := waitToken(ctx, client.Publish(topic, mqttQoS["AtLeastOnce"], retained, payload)); err != nil {
+		a.logger.Error("publish failed", "topic", topic, "error", err)
+		if ctx.Err() != nil {
+			return err
 		}
+		return &PublishError{Topic: topic, Err: err}
 	}
-	return result
+	return nil
 }
 
-func (a *agent) getCredentailFromDCCS() error {
+func (a *agent) getCredentailFromDCCS(ctx context.Context) error {
 	url := a.options.DCCS.URL
 	if url[len(url)-1:] == "/" {
 		a.options.DCCS.URL = url[:len(url)-1]
 	}
 	url = fmt.Sprintf("%s/v1/serviceCredentials/%s", a.options.DCCS.URL, a.options.DCCS.Key)
-	res, error := http.Get(url)
+	req, error := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if error != nil {
 		return error
 	}
+	client := &http.Client{
+		Timeout: time.Duration(dccsRequestTimeout) * time.Second,
+	}
+	if a.options.MQTT.TLS != nil {
+		tlsConfig, err := a.options.MQTT.TLS.tlsConfig()
+		if err != nil {
+			return err
+		}
+		// ServerName is meant for the broker, not for the DCCS host
+		tlsConfig.ServerName = ""
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	res, error := client.Do(req)
+	if error != nil {
+		return error
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("DCCS responded with status %s", res.Status)
+	}
 
 	body, error := ioutil.ReadAll(res.Body)
 	if error != nil {
@@ -259,14 +695,8 @@ func (a *agent) getCredentailFromDCCS() error {
 	return nil
 }
 
-func (a *agent) newClientOptions() (*MQTT.ClientOptions, error) {
-	clientOptions := MQTT.NewClientOptions()
+func (a *agent) newTransportOptions() (*TransportOptions, error) {
 	schema := protocolScheme[Protocol["TCP"]]
-	// Enable Debug
-	// MQTT.DEBUG = log.New(os.Stdout, "[Debug] ", 0)
-	// MQTT.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
-	// MQTT.CRITICAL = log.New(os.Stdout, "[CRIT] ", 0)
-	// MQTT.WARN = log.New(os.Stdout, "[WARN]  ", 0)
 
 	if a.options.MQTT.ProtocalType == Protocol["WebSocket"] {
 		schema = protocolScheme[Protocol["WebSocket"]]
@@ -274,37 +704,35 @@ func (a *agent) newClientOptions() (*MQTT.ClientOptions, error) {
 	if a.options.MQTT.ProtocalType == Protocol["TLS"] {
 		schema = protocolScheme[Protocol["TLS"]]
 	}
+	if a.options.MQTT.ProtocalType == Protocol["SecureWebSocket"] {
+		schema = protocolScheme[Protocol["SecureWebSocket"]]
+	}
 
-	server := fmt.Sprintf("%s://%s:%d", schema, a.options.MQTT.HostName, a.options.MQTT.Port)
-	clientOptions.AddBroker(server)
-	uuid := UUID.New()
-	clientOptions.SetClientID(fmt.Sprintf("EdgeAgent_%s", uuid))
-	clientOptions.SetAutoReconnect(true)
-	clientOptions.SetConnectRetry(true)
-	clientOptions.SetConnectRetryInterval(time.Duration(a.options.ReconnectInterval) * time.Second)
-	clientOptions.SetCleanSession(false)
-	clientOptions.SetPassword(a.options.MQTT.Password)
-	clientOptions.SetUsername(a.options.MQTT.UserName)
-	clientOptions.SetMaxReconnectInterval(time.Duration(a.options.ReconnectInterval) * time.Second)
-	topic := fmt.Sprintf(mqttTopic["NodeConnTopic"], a.options.NodeID)
-	payload := newWillMessage().getPayload()
-	clientOptions.SetWill(topic, payload, mqttQoS["AtLeastOnce"], true)
-
-	clientOptions.SetOnConnectHandler(a.handleOnConnect)
-	clientOptions.SetConnectionLostHandler(func(c MQTT.Client, err error) {
-		fmt.Println("Reconnecting...")
+	var tlsConfig *tls.Config
+	if a.options.MQTT.TLS != nil && (schema == "tls" || schema == "wss") {
+		config, err := a.options.MQTT.TLS.tlsConfig()
 		if err != nil {
-			fmt.Println(err)
+			return nil, err
 		}
-		if a.options.ConnectType == ConnectType["DCCS"] {
-			error := a.getCredentailFromDCCS()
-			if error != nil {
-				fmt.Println(err)
-			}
-		}
-		go a.OnDisconnect(a)
-	})
-	return clientOptions, nil
+		tlsConfig = config
+	}
+
+	uuid := UUID.New()
+	return &TransportOptions{
+		Broker:            fmt.Sprintf("%s://%s:%d", schema, a.options.MQTT.HostName, a.options.MQTT.Port),
+		ClientID:          fmt.Sprintf("EdgeAgent_%s", uuid),
+		UserName:          a.options.MQTT.UserName,
+		Password:          a.options.MQTT.Password,
+		CleanSession:      false,
+		ReconnectInterval: time.Duration(a.options.ReconnectInterval) * time.Second,
+		WillTopic:         fmt.Sprintf(mqttTopic["NodeConnTopic"], a.options.NodeID),
+		WillPayload:       newWillMessage().getPayload(),
+		WillQoS:           mqttQoS["AtLeastOnce"],
+		WillRetained:      true,
+		TLSConfig:         tlsConfig,
+		OnConnect:         a.handleOnConnect,
+		OnConnectionLost:  a.handleConnectionLost,
+	}, nil
 }
 
 func (a *agent) SetOnConnectHandler(onConn OnConnectHandler) {
@@ -319,18 +747,19 @@ func (a *agent) SetOnMessageReceiveHandler(onMessageReceive OnMessageReceiveHand
 	a.OnMessageReceive = onMessageReceive
 }
 
-func (a *agent) handleOnConnect(c MQTT.Client) {
+func (a *agent) handleOnConnect() {
 	/* subscribe */
 	cmdTopic := fmt.Sprintf(mqttTopic["DeviceCmdTopic"], a.options.NodeID, a.options.DeviceID)
 	if a.options.Type == EdgeType["Gateway"] {
 		cmdTopic = fmt.Sprintf(mqttTopic["NodeCmdTopic"], a.options.NodeID)
 	}
-	if token := a.client.Subscribe(cmdTopic, mqttQoS["AtLeastOnce"], a.handleCmdReceive); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
+	client := a.transport
+	if token := client.Subscribe(cmdTopic, mqttQoS["AtLeastOnce"], a.handleCmdReceive); token.Wait() && token.Error() != nil {
+		a.logger.Error("subscribe failed", "topic", cmdTopic, "error", token.Error())
 	}
 	ackTopic := fmt.Sprintf(mqttTopic["AckTopic"], a.options.NodeID)
-	if token := a.client.Subscribe(ackTopic, mqttQoS["AtLeastOnce"], a.handleAckReceive); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
+	if token := client.Subscribe(ackTopic, mqttQoS["AtLeastOnce"], a.handleAckReceive); token.Wait() && token.Error() != nil {
+		a.logger.Error("subscribe failed", "topic", ackTopic, "error", token.Error())
 	}
 
 	/* Send connect Message */
@@ -339,57 +768,76 @@ func (a *agent) handleOnConnect(c MQTT.Client) {
 		topic = fmt.Sprintf(mqttTopic["NodeConnTopic"], a.options.NodeID)
 	}
 	payload := newConnMessage().getPayload()
-	if token := a.client.Publish(topic, mqttQoS["AtLeastOnce"], true, payload); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-	}
-
-	/* heartbeat */
-	if a.options.HeartBeatInterval > 0 && a.heartbeatTimer == nil {
-		interval := a.options.HeartBeatInterval
-		a.heartbeatTimer = setInterval(a.sendHeartBeat, interval, true)
-	}
+	a.publishTo(context.Background(), client, topic, true, payload)
+
+	a.clientLock.Lock()
+	// Disconnect may have run before this handler
+	if a.client != nil {
+		/* heartbeat */
+		if a.options.HeartBeatInterval > 0 && a.heartbeatTimer == nil {
+			interval := a.options.HeartBeatInterval
+			a.heartbeatTimer = setInterval(a.sendHeartBeat, interval, true)
+		}
 
-	/* Recover */
-	if a.options.DataRecover && a.dataRecoverTimer == nil {
-		a.dataRecoverTimer = setInterval(a.sendRecover, dataRecoverInterval, true)
+		/* Recover */
+		if a.options.DataRecover && a.dataRecoverTimer == nil {
+			a.dataRecoverTimer = setInterval(a.sendRecover, dataRecoverInterval, true)
+		}
 	}
+	a.clientLock.Unlock()
 
 	go a.OnConnect(a)
 }
 
-func (a *agent) handleDisconnect() {
-	for a.client.IsConnectionOpen() {
+func (a *agent) handleConnectionLost(err error) {
+	a.logger.Warn("connection lost, reconnecting", "error", err)
+	if a.options.ConnectType == ConnectType["DCCS"] {
+		error := a.getCredentailFromDCCS(context.Background())
+		if error != nil {
+			a.logger.Error("get credential from DCCS failed", "error", error)
+		}
 	}
-	fmt.Println("Disconnected...")
+	go a.OnDisconnect(a)
+}
+
+func (a *agent) handleDisconnect() {
+	a.logger.Info("disconnected")
+	a.clientLock.Lock()
 	a.client = nil
-	a.heartbeatTimer <- false
-	a.heartbeatTimer = nil
-	a.dataRecoverTimer <- false
-	a.dataRecoverTimer = nil
+	if a.heartbeatTimer != nil {
+		a.heartbeatTimer <- false
+		a.heartbeatTimer = nil
+	}
+	if a.dataRecoverTimer != nil {
+		a.dataRecoverTimer <- false
+		a.dataRecoverTimer = nil
+	}
+	a.clientLock.Unlock()
 	go a.OnDisconnect(a)
 }
 
-func (a *agent) handleCmdReceive(c MQTT.Client, msg MQTT.Message) {
-	payload := string(msg.Payload())
+func (a *agent) handleCmdReceive(topic string, msg []byte) {
+	payload := string(msg)
 	if !isJSON(payload) {
-		fmt.Println("Invalid JSON format")
+		a.logger.Warn("invalid JSON format", "topic", topic)
 		return
 	}
 	var data cmdMessage
 	if err := json.Unmarshal([]byte(payload), &data); err != nil {
-		fmt.Println("Cmd decode failed:", err)
+		a.logger.Warn("cmd decode failed", "topic", topic, "error", err)
+		return
 	}
 	var message interface{}
 	var argType byte
 	switch data.D.Cmd {
 	case "WV":
 		argType = MessageType["WriteValue"]
-		message = getWriteDataMessageFromCmdMessage(data.D.Val, data.Ts)
+		message = getWriteDataMessageFromCmdMessage(data.D.Val, data.Ts, a.logger)
 	case "TSyn":
 		argType = MessageType["TimeSync"]
 		message = getTimeSyncMessageFromCmdMessage(data.D.UTC)
 	default:
-		// fmt.Println("Message format is invalid")
+		a.logger.Debug("unknown cmd", "topic", topic, "cmd", data.D.Cmd)
 		return
 	}
 	res := MessageReceivedEventArgs{
@@ -399,26 +847,36 @@ func (a *agent) handleCmdReceive(c MQTT.Client, msg MQTT.Message) {
 	go a.OnMessageReceive(res)
 }
 
-func (a *agent) handleAckReceive(c MQTT.Client, msg MQTT.Message) {
-	payload := string(msg.Payload())
+func (a *agent) handleAckReceive(topic string, msg []byte) {
+	payload := string(msg)
 	if !isJSON(payload) {
-		fmt.Println("Invalid JSON format")
+		a.logger.Warn("invalid JSON format", "topic", topic)
 		return
 	}
 	var data ackConfigMessage
 	if err := json.Unmarshal([]byte(payload), &data); err != nil {
-		fmt.Println("Ack decode failed:", err)
+		a.logger.Warn("ack decode failed", "topic", topic, "error", err)
 		return
 	}
 	val, ok := data.D.Cfg.(float64)
 	if data.D.Cfg == nil || !ok {
-		// fmt.Println("Message format is invalid")
+		a.logger.Debug("unknown ack", "topic", topic)
 		return
 	}
 	var result = false
 	if val > 0 {
 		result = true
 	}
+
+	a.ackLock.Lock()
+	if a.ackWaiter != nil {
+		select {
+		case a.ackWaiter <- result:
+		default:
+		}
+	}
+	a.ackLock.Unlock()
+
 	message := ConfigAckMessage{
 		Result: result,
 	}
@@ -438,9 +896,7 @@ func (a *agent) sendHeartBeat() {
 		topic = fmt.Sprintf(mqttTopic["NodeConnTopic"], a.options.NodeID)
 	}
 	payload := newHeartBeatMessage().getPayload()
-	if token := a.client.Publish(topic, mqttQoS["AtLeastOnce"], true, payload); token.Wait() && token.Error() != nil {
-		fmt.Println("token error in sendHeartBeat: ", token.Error())
-	}
+	a.publish(context.Background(), topic, true, payload)
 }
 
 func (a *agent) sendRecover() {
@@ -450,21 +906,46 @@ func (a *agent) sendRecover() {
 	if a.dataRecoverHelper == nil {
 		return
 	}
+	if !atomic.CompareAndSwapInt32(&a.recovering, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&a.recovering, 0)
 	helper := a.dataRecoverHelper
 
 	if !helper.IsDataExist() {
 		return
 	}
-	messages := helper.Read(defaultReadRecordCount)
 	topic := fmt.Sprintf(mqttTopic["DataTopic"], a.options.NodeID)
-	for _, message := range messages {
+	acker, ok := helper.(DataRecoverAcker)
+	if !ok {
+		// Read already removed the messages, the ones not delivered are
+		// written back and replayed in a later round
+		messages := helper.Read(defaultReadRecordCount)
+		for i, message := range messages {
+			if !a.IsConnected() || a.publish(context.Background(), topic, false, message) != nil {
+				for _, message := range messages[i:] {
+					helper.Write(message)
+				}
+				break
+			}
+		}
+		return
+	}
+	records, err := acker.Peek(defaultReadRecordCount)
+	if err != nil {
+		return
+	}
+	// records stay in the store until the broker confirms them, the first
+	// failure stops the replay so the order is kept for the next round
+	var ids []int64
+	for _, record := range records {
 		if !a.IsConnected() {
-			helper.Write(message)
-			continue
+			break
 		}
-		if token := a.client.Publish(topic, mqttQoS["AtLeastOnce"], false, message); token.Wait() && token.Error() != nil {
-			fmt.Println("token error in sendRecover: ", token.Error())
-			helper.Write(message)
+		if err := a.publish(context.Background(), topic, false, record.Message); err != nil {
+			break
 		}
+		ids = append(ids, record.ID)
 	}
+	acker.Ack(ids...)
 }
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// inDir runs f with dir as working directory.
+func inDir(t *testing.T, dir string, f func()) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	f()
+}
+
+func newStateTestAgent(stateDir string) *agent {
+	options := NewEdgeAgentOptions()
+	options.NodeID = "node1"
+	options.StateDir = stateDir
+	options.Transport = NewMemoryTransport()
+	options.Logger = NewNopLogger()
+	options.DataRecover = true
+	options.DataRecoverType = DataRecoverType["SQLite"]
+	return NewAgent(options).(*agent)
+}
+
+func TestStatePathLegacyFiles(t *testing.T) {
+	if !cgoEnabled {
+		t.Skip("SQLite needs cgo")
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	inDir(t, dir, func() {
+		for _, name := range []string{tagsCfgFilePath, dataRecoverFilePath} {
+			if err := ioutil.WriteFile(name, []byte("{}"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a := newStateTestAgent("state")
+		if want := filepath.Join("state", "node1", tagsCfgFilePath); a.tagsCfgFilePath != want {
+			t.Fatalf("tagsCfgFilePath = %q, want %q", a.tagsCfgFilePath, want)
+		}
+		if want := filepath.Join("state", "node1", dataRecoverFilePath); a.dataRecoverHelper.(*dataRecoverHelper).filePath != want {
+			t.Fatalf("recover path = %q, want %q", a.dataRecoverHelper.(*dataRecoverHelper).filePath, want)
+		}
+		for _, name := range []string{tagsCfgFilePath, dataRecoverFilePath} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Fatalf("legacy %s not moved: %v", name, err)
+			}
+			if _, err := os.Stat(filepath.Join("state", "node1", name)); err != nil {
+				t.Fatalf("%s not in the state directory: %v", name, err)
+			}
+		}
+	})
+}
+
+func TestStatePathCreatedOnWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	inDir(t, dir, func() {
+		a := newStateTestAgent("")
+		if _, err := os.Stat("node1"); !os.IsNotExist(err) {
+			t.Fatalf("NewAgent created the state directory: %v", err)
+		}
+		if !newTagsCfgHelper().addCfgToFile(a, a.tagsCfgFilePath) {
+			t.Fatal("addCfgToFile failed")
+		}
+		if _, err := os.Stat(filepath.Join("node1", tagsCfgFilePath)); err != nil {
+			t.Fatalf("config cache not written: %v", err)
+		}
+	})
+}
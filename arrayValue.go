@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// AnalogArray is the value of an analog array tag. Like the other array
+// values it is sent as the index map DataHub expects, {"0":1.5,"1":2}.
+// The length is only checked against the tag ArraySize with DataValidation.
+type AnalogArray []float64
+
+// DiscreteArray is the value of a discrete array tag.
+type DiscreteArray []int
+
+// TextArray is the value of a text array tag.
+type TextArray []string
+
+// ArrayUpdate sets only the listed indexes of an array tag,
+// e.g. ArrayUpdate{3: 1.5} for index 3 of an analog array. A negative index
+// fails to encode, the tag ArraySize is only checked with DataValidation or
+// by Validate.
+type ArrayUpdate map[int]interface{}
+
+// NewAnalogArrayUpdate returns the ArrayUpdate of an analog array tag.
+func NewAnalogArrayUpdate(values map[int]float64) ArrayUpdate {
+	update := make(ArrayUpdate, len(values))
+	for index, value := range values {
+		update[index] = value
+	}
+	return update
+}
+
+// NewDiscreteArrayUpdate returns the ArrayUpdate of a discrete array tag.
+func NewDiscreteArrayUpdate(values map[int]int) ArrayUpdate {
+	update := make(ArrayUpdate, len(values))
+	for index, value := range values {
+		update[index] = value
+	}
+	return update
+}
+
+// NewTextArrayUpdate returns the ArrayUpdate of a text array tag.
+func NewTextArrayUpdate(values map[int]string) ArrayUpdate {
+	update := make(ArrayUpdate, len(values))
+	for index, value := range values {
+		update[index] = value
+	}
+	return update
+}
+
+// Validate checks every index is within arraySize.
+func (values ArrayUpdate) Validate(arraySize uint) error {
+	for index := range values {
+		if index < 0 || index >= int(arraySize) {
+			return fmt.Errorf("index %d out of array size %d", index, arraySize)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON ...
+func (values AnalogArray) MarshalJSON() ([]byte, error) {
+	m := make(map[string]float64, len(values))
+	for i, value := range values {
+		m[strconv.Itoa(i)] = value
+	}
+	return json.Marshal(m)
+}
+
+// MarshalJSON ...
+func (values DiscreteArray) MarshalJSON() ([]byte, error) {
+	m := make(map[string]int, len(values))
+	for i, value := range values {
+		m[strconv.Itoa(i)] = value
+	}
+	return json.Marshal(m)
+}
+
+// MarshalJSON ...
+func (values TextArray) MarshalJSON() ([]byte, error) {
+	m := make(map[string]string, len(values))
+	for i, value := range values {
+		m[strconv.Itoa(i)] = value
+	}
+	return json.Marshal(m)
+}
+
+// MarshalJSON ...
+func (values ArrayUpdate) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(values))
+	for index, value := range values {
+		if index < 0 {
+			return nil, fmt.Errorf("negative array index %d", index)
+		}
+		m[strconv.Itoa(index)] = value
+	}
+	return json.Marshal(m)
+}
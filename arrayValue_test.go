@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArrayValueJSON(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		json  string
+	}{
+		{AnalogArray{1.5, 2}, `{"0":1.5,"1":2}`},
+		{DiscreteArray{0, 7}, `{"0":0,"1":7}`},
+		{TextArray{"a", "b"}, `{"0":"a","1":"b"}`},
+		{AnalogArray{}, `{}`},
+		{NewAnalogArrayUpdate(map[int]float64{3: 1.5}), `{"3":1.5}`},
+		{NewDiscreteArrayUpdate(map[int]int{0: 1, 10: 2}), `{"0":1,"10":2}`},
+		{NewTextArrayUpdate(map[int]string{2: "on"}), `{"2":"on"}`},
+	}
+	for _, test := range tests {
+		j, err := json.Marshal(test.value)
+		if err != nil || string(j) != test.json {
+			t.Errorf("%#v = %s, %v, want %s", test.value, j, err, test.json)
+		}
+	}
+	if _, err := json.Marshal(ArrayUpdate{-1: 1.5}); err == nil {
+		t.Error("negative index encoded")
+	}
+}
+
+func TestArrayUpdateValidate(t *testing.T) {
+	update := NewAnalogArrayUpdate(map[int]float64{0: 1, 4: 2})
+	if err := update.Validate(5); err != nil {
+		t.Fatalf("Validate(5) = %v", err)
+	}
+	if err := update.Validate(4); err == nil || err.Error() != "index 4 out of array size 4" {
+		t.Fatalf("Validate(4) = %v", err)
+	}
+	if err := (ArrayUpdate{-1: 1}).Validate(4); err == nil {
+		t.Fatal("negative index accepted")
+	}
+}
+
+func TestArrayValueSend(t *testing.T) {
+	options := NewEdgeAgentOptions()
+	options.Logger = NewNopLogger()
+	options.Transport = NewMemoryTransport()
+	options.DataRecover = false
+	options.FractionConvert = FractionConvert["None"]
+	a := NewAgent(options).(*agent)
+
+	data := EdgeData{Timestamp: time.Now(), TagList: []EdgeTag{
+		{DeviceID: "Device1", TagName: "Sparse", Value: ArrayUpdate{2: 1.5}},
+		{DeviceID: "Device1", TagName: "Negative", Value: ArrayUpdate{-1: 1.5}},
+		{DeviceID: "Device1", TagName: "NaN", Value: AnalogArray{math.NaN()}},
+	}}
+	payloads, rejected := convertTagValue(data, a)
+	if len(payloads) != 1 || !strings.Contains(payloads[0], `"Sparse":{"2":1.5}`) {
+		t.Fatalf("payloads = %q", payloads)
+	}
+	errs := make(map[string]error)
+	for _, err := range rejected {
+		errs[err.TagName] = err
+	}
+	if len(rejected) != 2 || errs["Negative"] == nil || errs["NaN"] == nil {
+		t.Fatalf("rejected = %v", rejected)
+	}
+	var unsupported *json.UnsupportedValueError
+	if !errors.As(errs["NaN"], &unsupported) {
+		t.Fatalf("NaN error = %v", errs["NaN"])
+	}
+}
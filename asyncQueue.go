@@ -0,0 +1,288 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AsyncOptions makes SendData queue the data and return, a background
+// worker collects the queued tag values for BatchWindow, or until BatchSize
+// values are queued, and publishes them. Data with the same timestamp is
+// merged into the same payloads, failed payloads are spooled to the
+// DataRecoverHelper.
+type AsyncOptions struct {
+	QueueSize    int           // tag values, default 10000
+	BatchWindow  time.Duration // default 1s
+	BatchSize    int           // tag values, default 100
+	BackPressure byte          // when the queue is full, see BackPressure
+}
+
+type asyncQueue struct {
+	agent   *agent
+	options AsyncOptions
+	lock    sync.Mutex
+	items   []EdgeData
+	count   int
+	room    chan struct{} // closed when the worker takes the queue
+	wake    chan struct{}
+	flush   chan chan error
+	stop    chan struct{} // closed to stop the worker, nil when it is not running
+	stopped chan struct{} // closed when the worker exits
+	cancel  context.CancelFunc
+}
+
+func newAsyncQueue(a *agent, options AsyncOptions) *asyncQueue {
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultAsyncQueueSize
+	}
+	if options.BatchWindow <= 0 {
+		options.BatchWindow = time.Duration(defaultAsyncBatchWindow) * time.Millisecond
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = dataMaxTagCount
+	}
+	return &asyncQueue{
+		agent:   a,
+		options: options,
+		room:    make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		flush:   make(chan chan error),
+	}
+}
+
+// enqueue adds data to the queue, applying the BackPressure when it is
+// full. Data larger than the queue is accepted when the queue is empty.
+// Without a worker, before Connect or after Disconnect, the data is
+// spilled to the DataRecoverHelper or fails with ErrNotConnected.
+func (q *asyncQueue) enqueue(ctx context.Context, data EdgeData, result SendResult) (SendResult, error) {
+	size := len(data.TagList)
+	q.lock.Lock()
+	for q.stop == nil || q.count > 0 && q.count+size > q.options.QueueSize {
+		if q.stop == nil {
+			q.lock.Unlock()
+			return q.spill(data, result, ErrNotConnected)
+		}
+		switch q.options.BackPressure {
+		case BackPressure["Drop"]:
+			q.lock.Unlock()
+			q.agent.logger.Warn("send queue is full, data dropped", "tags", size)
+			q.agent.forgetSent(data.TagList)
+			result.Dropped++
+			return result, ErrQueueFull
+		case BackPressure["Spill"]:
+			q.lock.Unlock()
+			return q.spill(data, result, ErrQueueFull)
+		}
+
+		room := q.room
+		q.lock.Unlock()
+		select {
+		case <-room:
+		case <-ctx.Done():
+			q.agent.forgetSent(data.TagList)
+			return result, ctx.Err()
+		}
+		q.lock.Lock()
+	}
+
+	wasEmpty := q.count == 0
+	q.items = append(q.items, data)
+	q.count += size
+	full := q.count >= q.options.BatchSize
+	q.lock.Unlock()
+
+	if wasEmpty || full {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	result.Queued += size
+	return result, nil
+}
+
+// spill writes data straight to the DataRecoverHelper, one payload per
+// sample time like publish. It returns reason when data is dropped.
+func (q *asyncQueue) spill(data EdgeData, result SendResult, reason error) (SendResult, error) {
+	a := q.agent
+	if a.dataRecoverHelper == nil {
+		a.forgetSent(data.TagList)
+		result.Dropped++
+		return result, reason
+	}
+	var rejected []*TagValueError
+	for _, batch := range groupByTimestamp([]EdgeData{data}) {
+		payloads, batchRejected := convertTagValue(batch, a)
+		rejected = append(rejected, batchRejected...)
+		result.Rejected += len(batchRejected)
+		for _, payload := range payloads {
+			if a.dataRecoverHelper.Write(payload) {
+				result.Spooled++
+			} else {
+				result.Dropped++
+			}
+		}
+	}
+	if result.Dropped > 0 {
+		a.forgetSent(data.TagList)
+		return result, reason
+	}
+	if len(rejected) > 0 {
+		a.forgetSent(data.TagList)
+		return result, rejected[0]
+	}
+	return result, nil
+}
+
+// Flush publishes the queued data now and waits until it is published or
+// spooled. It returns the first publish failure, or ErrNotConnected when
+// data is queued while the agent is disconnected.
+func (a *agent) Flush(ctx context.Context) error {
+	q := a.async
+	if q == nil {
+		return nil
+	}
+	q.lock.Lock()
+	stop, count := q.stop, q.count
+	q.lock.Unlock()
+	if stop == nil {
+		if count > 0 {
+			return ErrNotConnected
+		}
+		return nil
+	}
+
+	done := make(chan error, 1)
+	select {
+	case q.flush <- done:
+	case <-stop:
+		return ErrNotConnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start starts the worker publishing with client unless it is running. It
+// does nothing on a nil queue.
+func (q *asyncQueue) start(client Transport) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.stop != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.stop = make(chan struct{})
+	q.stopped = make(chan struct{})
+	q.cancel = cancel
+	go q.run(ctx, client, q.stop, q.stopped)
+	if q.count > 0 {
+		// data left queued by the last Disconnect
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close stops the worker and waits for it. When ctx is done first the
+// publish in progress is cancelled, spooling what it could not publish.
+// The data still queued is kept for the next start. It does nothing on a
+// nil queue.
+func (q *asyncQueue) close(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+	q.lock.Lock()
+	stop, stopped, cancel := q.stop, q.stopped, q.cancel
+	q.stop = nil
+	// wake the blocked senders, they spill now
+	close(q.room)
+	q.room = make(chan struct{})
+	q.lock.Unlock()
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	defer cancel()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		<-stopped
+		return ctx.Err()
+	}
+}
+
+func (q *asyncQueue) run(ctx context.Context, client Transport, stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+	for {
+		var done chan error
+		select {
+		case <-q.wake:
+		case done = <-q.flush:
+		case <-stop:
+			return
+		}
+
+		if done == nil && q.size() < q.options.BatchSize {
+			timer := time.NewTimer(q.options.BatchWindow)
+			select {
+			case <-timer.C:
+			case <-q.wake:
+			case done = <-q.flush:
+			case <-stop:
+			}
+			timer.Stop()
+		}
+
+		err := q.publish(ctx, client, q.take())
+		if done != nil {
+			done <- err
+		}
+	}
+}
+
+func (q *asyncQueue) size() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.count
+}
+
+// take empties the queue and wakes the blocked senders.
+func (q *asyncQueue) take() []EdgeData {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	items := q.items
+	q.items = nil
+	q.count = 0
+	close(q.room)
+	q.room = make(chan struct{})
+	return items
+}
+
+// publish merges the data by timestamp and publishes it in time order.
+func (q *asyncQueue) publish(ctx context.Context, client Transport, items []EdgeData) error {
+	var firstErr error
+	for _, data := range groupByTimestamp(items) {
+		result, err := q.agent.publishData(ctx, client, data, SendResult{})
+		if err != nil {
+			q.agent.logger.Warn("async publish failed", "spooled", result.Spooled, "dropped", result.Dropped, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
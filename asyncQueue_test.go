@@ -0,0 +1,392 @@
+package agent_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	agent "github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK"
+	"github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK/datahubtest"
+)
+
+// stallTransport holds data publishes until the gate is opened, like a
+// broker which stopped acknowledging.
+type stallTransport struct {
+	*agent.MemoryTransport
+	lock    sync.Mutex
+	gate    chan struct{}
+	stalled chan struct{}
+}
+
+func (t *stallTransport) stall() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.gate = make(chan struct{})
+}
+
+func (t *stallTransport) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.gate != nil {
+		close(t.gate)
+		t.gate = nil
+	}
+}
+
+func (t *stallTransport) Publish(topic string, qos byte, retained bool, payload string) agent.Token {
+	t.lock.Lock()
+	gate := t.gate
+	t.lock.Unlock()
+	if gate == nil || !strings.HasSuffix(topic, "/data") {
+		return t.MemoryTransport.Publish(topic, qos, retained, payload)
+	}
+	select {
+	case t.stalled <- struct{}{}:
+	default:
+	}
+	token := &gateToken{done: make(chan struct{})}
+	go func() {
+		<-gate
+		token.err = t.MemoryTransport.Publish(topic, qos, retained, payload).Error()
+		close(token.done)
+	}()
+	return token
+}
+
+type gateToken struct {
+	done chan struct{}
+	err  error
+}
+
+func (t *gateToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *gateToken) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *gateToken) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+func newAsyncAgent(t *testing.T, server *datahubtest.Server, async agent.AsyncOptions, recover agent.DataRecoverHelper) (agent.Agent, *stallTransport) {
+	t.Helper()
+	options := server.AgentOptions("node1")
+	options.Logger = agent.NewNopLogger()
+	options.Async = &async
+	if recover != nil {
+		options.DataRecover = true
+		options.DataRecoverHelper = recover
+	}
+	transport := &stallTransport{
+		MemoryTransport: options.Transport.(*agent.MemoryTransport),
+		stalled:         make(chan struct{}, 1),
+	}
+	options.Transport = transport
+	edgeAgent := agent.NewAgent(options)
+	connect(t, edgeAgent)
+	return edgeAgent, transport
+}
+
+func asyncData(ts time.Time, tags ...string) agent.EdgeData {
+	data := agent.EdgeData{Timestamp: ts}
+	for i, tag := range tags {
+		data.TagList = append(data.TagList, agent.EdgeTag{DeviceID: "Device1", TagName: tag, Value: i})
+	}
+	return data
+}
+
+// flushStalled starts a Flush and waits until the worker is stuck publishing.
+func flushStalled(t *testing.T, edgeAgent agent.Agent, transport *stallTransport) chan error {
+	t.Helper()
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- edgeAgent.Flush(context.Background())
+	}()
+	select {
+	case <-transport.stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not publish")
+	}
+	return flushed
+}
+
+func TestAsyncBatching(t *testing.T) {
+	server := datahubtest.NewServer()
+	defer server.Close()
+	edgeAgent, _ := newAsyncAgent(t, server, agent.AsyncOptions{BatchWindow: time.Hour}, nil)
+	defer edgeAgent.Disconnect()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sends := []agent.EdgeData{
+		asyncData(start.Add(time.Second), "ATag1"),
+		asyncData(start, "ATag1", "ATag2"),
+		asyncData(start.Add(time.Second), "ATag2"),
+		asyncData(start, "ATag3"),
+	}
+	for i, data := range sends {
+		if result, err := edgeAgent.SendDataE(data); err != nil || result.Queued != len(data.TagList) {
+			t.Fatalf("SendData %d = %+v, %v", i, result, err)
+		}
+	}
+	if n := len(server.Data("node1")); n != 0 {
+		t.Fatalf("%d payloads published before the batch window", n)
+	}
+	if err := edgeAgent.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// one payload per sample time, merged across SendData calls
+	messages := server.Data("node1")
+	if len(messages) != 2 {
+		t.Fatalf("published %d payloads, want 2", len(messages))
+	}
+	if !messages[0].Timestamp.Equal(start) || len(messages[0].Values["Device1"]) != 3 {
+		t.Fatalf("first payload = %v %v", messages[0].Timestamp, messages[0].Values)
+	}
+	if !messages[1].Timestamp.Equal(start.Add(time.Second)) || len(messages[1].Values["Device1"]) != 2 {
+		t.Fatalf("second payload = %v %v", messages[1].Timestamp, messages[1].Values)
+	}
+}
+
+func TestAsyncBatchSize(t *testing.T) {
+	server := datahubtest.NewServer()
+	defer server.Close()
+	edgeAgent, _ := newAsyncAgent(t, server, agent.AsyncOptions{BatchWindow: time.Hour, BatchSize: 3}, nil)
+	defer edgeAgent.Disconnect()
+
+	now := time.Now()
+	edgeAgent.SendDataE(asyncData(now, "ATag1", "ATag2"))
+	edgeAgent.SendDataE(asyncData(now, "ATag3"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Data("node1")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if messages := server.Data("node1"); len(messages) != 1 || len(messages[0].Values["Device1"]) != 3 {
+		t.Fatalf("payloads = %+v, want one of 3 tags once BatchSize is reached", messages)
+	}
+}
+
+func TestAsyncBackPressure(t *testing.T) {
+	tests := []struct {
+		name         string
+		backPressure byte
+		recover      bool
+		check        func(t *testing.T, result agent.SendResult, err error)
+	}{
+		{
+			name:         "Drop",
+			backPressure: agent.BackPressure["Drop"],
+			check: func(t *testing.T, result agent.SendResult, err error) {
+				if !errors.Is(err, agent.ErrQueueFull) || result.Dropped != 1 {
+					t.Fatalf("SendData = %+v, %v, want dropped with ErrQueueFull", result, err)
+				}
+			},
+		},
+		{
+			name:         "Spill",
+			backPressure: agent.BackPressure["Spill"],
+			recover:      true,
+			check: func(t *testing.T, result agent.SendResult, err error) {
+				if err != nil || result.Spooled != 1 || result.Queued != 0 {
+					t.Fatalf("SendData = %+v, %v, want spooled", result, err)
+				}
+			},
+		},
+		{
+			name:         "Spill without recover",
+			backPressure: agent.BackPressure["Spill"],
+			check: func(t *testing.T, result agent.SendResult, err error) {
+				if !errors.Is(err, agent.ErrQueueFull) || result.Dropped != 1 {
+					t.Fatalf("SendData = %+v, %v, want dropped with ErrQueueFull", result, err)
+				}
+			},
+		},
+		{
+			name:         "Block",
+			backPressure: agent.BackPressure["Block"],
+			check: func(t *testing.T, result agent.SendResult, err error) {
+				if !errors.Is(err, context.DeadlineExceeded) || result.Queued != 0 {
+					t.Fatalf("SendData = %+v, %v, want blocked until the deadline", result, err)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := datahubtest.NewServer()
+			defer server.Close()
+			var recover agent.DataRecoverHelper
+			if test.recover {
+				recover = agent.NewMemoryDataRecoverHelper(agent.DataRecoverLimits{})
+			}
+			edgeAgent, transport := newAsyncAgent(t, server, agent.AsyncOptions{
+				QueueSize:    2,
+				BatchWindow:  time.Hour,
+				BackPressure: test.backPressure,
+			}, recover)
+			defer edgeAgent.Disconnect()
+			defer transport.release()
+
+			now := time.Now()
+			transport.stall()
+			edgeAgent.SendDataE(asyncData(now, "ATag1"))
+			flushed := flushStalled(t, edgeAgent, transport)
+			if result, err := edgeAgent.SendDataE(asyncData(now, "ATag2", "ATag3")); err != nil || result.Queued != 2 {
+				t.Fatalf("SendData = %+v, %v, want queued", result, err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			result, err := edgeAgent.SendDataContext(ctx, asyncData(now, "ATag4"))
+			test.check(t, result, err)
+			if test.recover && !recover.IsDataExist() {
+				t.Fatal("nothing spooled")
+			}
+
+			transport.release()
+			if err := <-flushed; err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if err := edgeAgent.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if n := len(server.Data("node1")); n != 2 {
+				t.Fatalf("published %d payloads, want 2", n)
+			}
+		})
+	}
+}
+
+func TestAsyncBlockResumes(t *testing.T) {
+	server := datahubtest.NewServer()
+	defer server.Close()
+	edgeAgent, transport := newAsyncAgent(t, server, agent.AsyncOptions{QueueSize: 1, BatchWindow: time.Hour}, nil)
+	defer edgeAgent.Disconnect()
+	defer transport.release()
+
+	now := time.Now()
+	transport.stall()
+	edgeAgent.SendDataE(asyncData(now, "ATag1"))
+	flushed := flushStalled(t, edgeAgent, transport)
+	edgeAgent.SendDataE(asyncData(now, "ATag2"))
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := edgeAgent.SendDataE(asyncData(now, "ATag3"))
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("SendData returned %v on a full queue", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	transport.release()
+	<-flushed
+	// the next batch makes room for the blocked sender
+	if err := edgeAgent.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("blocked SendData = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked SendData not resumed")
+	}
+	if err := edgeAgent.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if n := len(server.Data("node1")); n != 3 {
+		t.Fatalf("published %d payloads, want 3", n)
+	}
+}
+
+func TestAsyncDisconnectStalled(t *testing.T) {
+	server := datahubtest.NewServer()
+	defer server.Close()
+	recover := agent.NewMemoryDataRecoverHelper(agent.DataRecoverLimits{})
+	edgeAgent, transport := newAsyncAgent(t, server, agent.AsyncOptions{BatchWindow: time.Hour}, recover)
+	defer transport.release()
+
+	transport.stall()
+	edgeAgent.SendDataE(asyncData(time.Now(), "ATag1"))
+	flushStalled(t, edgeAgent, transport)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	disconnected := make(chan error, 1)
+	go func() {
+		disconnected <- edgeAgent.DisconnectContext(ctx)
+	}()
+	select {
+	case err := <-disconnected:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Disconnect = %v, want the deadline", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Disconnect hangs on a stalled broker")
+	}
+	if !recover.IsDataExist() {
+		t.Fatal("the cancelled publish was not spooled")
+	}
+}
+
+func TestAsyncAfterDisconnect(t *testing.T) {
+	for _, spill := range []bool{false, true} {
+		t.Run(fmt.Sprintf("recover %v", spill), func(t *testing.T) {
+			server := datahubtest.NewServer()
+			defer server.Close()
+			var recover agent.DataRecoverHelper
+			if spill {
+				recover = agent.NewMemoryDataRecoverHelper(agent.DataRecoverLimits{})
+			}
+			edgeAgent, _ := newAsyncAgent(t, server, agent.AsyncOptions{BatchWindow: time.Millisecond}, recover)
+			if err := edgeAgent.DisconnectContext(context.Background()); err != nil {
+				t.Fatalf("Disconnect: %v", err)
+			}
+
+			result, err := edgeAgent.SendDataE(asyncData(time.Now(), "ATag1"))
+			switch {
+			case spill && (err != nil || result.Spooled != 1):
+				t.Fatalf("SendData = %+v, %v, want spooled", result, err)
+			case !spill && (!errors.Is(err, agent.ErrNotConnected) || result.Dropped != 1):
+				t.Fatalf("SendData = %+v, %v, want ErrNotConnected", result, err)
+			}
+			if err := edgeAgent.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush after Disconnect: %v", err)
+			}
+
+			// a new Connect starts the worker again
+			connect(t, edgeAgent)
+			defer edgeAgent.Disconnect()
+			if result, err := edgeAgent.SendDataE(asyncData(time.Now(), "ATag2")); err != nil || result.Queued != 1 {
+				t.Fatalf("SendData after Connect = %+v, %v", result, err)
+			}
+			if err := edgeAgent.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if _, ok := server.LastValue("node1", "Device1", "ATag2"); !ok {
+				t.Fatal("data sent after reconnecting not published")
+			}
+		})
+	}
+}
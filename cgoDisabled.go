@@ -0,0 +1,8 @@
+//go:build !cgo
+// +build !cgo
+
+package agent
+
+// cgoEnabled tells whether the SQLite data recover store can be used,
+// go-sqlite3 built without cgo fails on every call.
+const cgoEnabled = false
@@ -0,0 +1,7 @@
+//go:build cgo
+// +build cgo
+
+package agent
+
+// cgoEnabled tells whether the SQLite data recover store can be used.
+const cgoEnabled = true
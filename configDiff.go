@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ConfigChange is one entry of a ConfigDiff. TagName is empty for a device
+// change and DeviceID is empty for a node change.
+type ConfigChange struct {
+	Action     byte
+	DeviceID   string
+	TagName    string
+	Attributes []string // changed attributes of an Update, e.g. "Desc", "SH"
+}
+
+func (c ConfigChange) String() string {
+	var action string
+	for name, value := range Action {
+		if value == c.Action {
+			action = name
+		}
+	}
+	target := "Node"
+	if c.DeviceID != "" {
+		target = fmt.Sprintf("Device[%q]", c.DeviceID)
+	}
+	if c.TagName != "" {
+		target += fmt.Sprintf(".Tag[%q]", c.TagName)
+	}
+	if len(c.Attributes) > 0 {
+		return fmt.Sprintf("%s %s %v", action, target, c.Attributes)
+	}
+	return fmt.Sprintf("%s %s", action, target)
+}
+
+// ConfigDiff is the minimal set of uploads turning the cached config into
+// the desired one.
+type ConfigDiff struct {
+	Changes []ConfigChange
+	create  map[string]interface{}
+	update  map[string]interface{}
+	delete  map[string]interface{}
+}
+
+// IsEmpty reports whether the desired config equals the cached one.
+func (d ConfigDiff) IsEmpty() bool {
+	return len(d.Changes) == 0
+}
+
+// normalizeConfig turns a converted config into the form it has after being
+// read back from cfgCache.json, so both can be compared.
+func normalizeConfig(v interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	j, err := json.Marshal(v)
+	if err != nil {
+		return m
+	}
+	json.Unmarshal(j, &m)
+	return m
+}
+
+func childMap(m map[string]interface{}, key string) map[string]interface{} {
+	if child, ok := m[key].(map[string]interface{}); ok {
+		return child
+	}
+	return map[string]interface{}{}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// changedAttributes returns the attributes of desired which differ from
+// cached. Attributes missing from desired are left as they are.
+func changedAttributes(desired map[string]interface{}, cached map[string]interface{}, skip string) []string {
+	var changed []string
+	for _, key := range sortedKeys(desired) {
+		if key == skip {
+			continue
+		}
+		if !reflect.DeepEqual(desired[key], cached[key]) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+func pick(m map[string]interface{}, keys []string) map[string]interface{} {
+	p := make(map[string]interface{})
+	for _, key := range keys {
+		p[key] = m[key]
+	}
+	return p
+}
+
+func addTag(node map[string]interface{}, deviceID string, tagName string, tag map[string]interface{}) {
+	devices := childMap(node, "Device")
+	node["Device"] = devices
+	device := childMap(devices, deviceID)
+	devices[deviceID] = device
+	tags := childMap(device, "Tag")
+	device["Tag"] = tags
+	tags[tagName] = tag
+}
+
+// diffConfig compares the desired node with the cached one, both normalized.
+func diffConfig(desired map[string]interface{}, cached map[string]interface{}) ConfigDiff {
+	diff := ConfigDiff{
+		create: make(map[string]interface{}),
+		update: make(map[string]interface{}),
+		delete: make(map[string]interface{}),
+	}
+
+	if len(cached) == 0 {
+		for key, value := range desired {
+			diff.create[key] = value
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Create"]})
+		for _, deviceID := range sortedKeys(childMap(desired, "Device")) {
+			diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Create"], DeviceID: deviceID})
+		}
+		return diff
+	}
+
+	if attrs := changedAttributes(desired, cached, "Device"); len(attrs) > 0 {
+		for key, value := range pick(desired, attrs) {
+			diff.update[key] = value
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Update"], Attributes: attrs})
+	}
+
+	desiredDevices := childMap(desired, "Device")
+	cachedDevices := childMap(cached, "Device")
+	for _, deviceID := range sortedKeys(desiredDevices) {
+		device := childMap(desiredDevices, deviceID)
+		cachedDevice, ok := cachedDevices[deviceID].(map[string]interface{})
+		if !ok {
+			devices := childMap(diff.create, "Device")
+			diff.create["Device"] = devices
+			devices[deviceID] = device
+			diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Create"], DeviceID: deviceID})
+			continue
+		}
+
+		if attrs := changedAttributes(device, cachedDevice, "Tag"); len(attrs) > 0 {
+			devices := childMap(diff.update, "Device")
+			diff.update["Device"] = devices
+			updated := childMap(devices, deviceID)
+			for key, value := range pick(device, attrs) {
+				updated[key] = value
+			}
+			devices[deviceID] = updated
+			diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Update"], DeviceID: deviceID, Attributes: attrs})
+		}
+
+		tags := childMap(device, "Tag")
+		cachedTags := childMap(cachedDevice, "Tag")
+		for _, tagName := range sortedKeys(tags) {
+			tag := childMap(tags, tagName)
+			cachedTag, ok := cachedTags[tagName].(map[string]interface{})
+			if ok && !reflect.DeepEqual(tag["Type"], cachedTag["Type"]) {
+				// a tag cannot change its type, it is deleted and created again
+				addTag(diff.delete, deviceID, tagName, map[string]interface{}{})
+				diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Delete"], DeviceID: deviceID, TagName: tagName})
+				ok = false
+			}
+			if !ok {
+				addTag(diff.create, deviceID, tagName, tag)
+				diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Create"], DeviceID: deviceID, TagName: tagName})
+				continue
+			}
+			if attrs := changedAttributes(tag, cachedTag, "Type"); len(attrs) > 0 {
+				updated := pick(tag, attrs)
+				updated["Type"] = tag["Type"]
+				addTag(diff.update, deviceID, tagName, updated)
+				diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Update"], DeviceID: deviceID, TagName: tagName, Attributes: attrs})
+			}
+		}
+		for _, tagName := range sortedKeys(cachedTags) {
+			if _, ok := tags[tagName]; !ok {
+				addTag(diff.delete, deviceID, tagName, map[string]interface{}{})
+				diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Delete"], DeviceID: deviceID, TagName: tagName})
+			}
+		}
+	}
+	for _, deviceID := range sortedKeys(cachedDevices) {
+		if _, ok := desiredDevices[deviceID]; !ok {
+			devices := childMap(diff.delete, "Device")
+			diff.delete["Device"] = devices
+			devices[deviceID] = map[string]interface{}{}
+			diff.Changes = append(diff.Changes, ConfigChange{Action: Action["Delete"], DeviceID: deviceID})
+		}
+	}
+	return diff
+}
+
+// DiffConfig compares edgeConfig with the cached config and returns the
+// changes SyncConfig would upload, without sending anything.
+func (a *agent) DiffConfig(config EdgeConfig) (ConfigDiff, error) {
+	message, err := a.convertConfig(Action["Create"], config)
+	if err != nil {
+		return ConfigDiff{}, err
+	}
+	desired := normalizeConfig(message.D.Scada[a.options.NodeID])
+
+	a.cfgLock.RLock()
+	var cached map[string]interface{}
+	if a.cfgCache.D.Scada != nil {
+		cached = normalizeConfig(a.cfgCache.D.Scada[a.options.NodeID])
+	}
+	a.cfgLock.RUnlock()
+
+	return diffConfig(desired, cached), nil
+}
+
+// SyncConfig uploads the minimal Delete, Create and Update messages turning
+// the cached config into edgeConfig, waiting for the ConfigAck of each like
+// UploadConfigAndWait. Every acknowledged step is applied to the cache, so
+// the cache matches DataHub after a failure as well. Attributes missing from
+// edgeConfig are kept, like DataHub keeps them. With dryRun it only returns
+// the diff.
+func (a *agent) SyncConfig(ctx context.Context, config EdgeConfig, dryRun bool) (ConfigDiff, error) {
+	diff, err := a.DiffConfig(config)
+	if err != nil || dryRun || diff.IsEmpty() {
+		return diff, err
+	}
+	if !a.IsConnected() {
+		return diff, ErrNotConnected
+	}
+
+	a.uploadLock.Lock()
+	defer a.uploadLock.Unlock()
+	uploads := []struct {
+		action byte
+		node   map[string]interface{}
+	}{
+		{Action["Delete"], diff.delete},
+		{Action["Create"], diff.create},
+		{Action["Update"], diff.update},
+	}
+	for _, upload := range uploads {
+		if len(upload.node) == 0 {
+			continue
+		}
+		message := newConfigData(upload.action)
+		message.D.Scada[a.options.NodeID] = normalizeConfig(upload.node)
+		if err := a.uploadConfigAndWait(ctx, message); err != nil {
+			return diff, err
+		}
+	}
+	return diff, nil
+}
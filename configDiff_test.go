@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	const base = `{"Hbt":60,"Device":{"D1":{"Name":"d1","Desc":"old","Tag":{"T1":{"Type":1,"SH":100}}}}}`
+	tests := []struct {
+		name    string
+		cached  string
+		desired string
+		changes []string
+		create  string
+		update  string
+		delete  string
+	}{
+		{
+			name:    "empty cache",
+			cached:  `{}`,
+			desired: base,
+			changes: []string{`Create Node`, `Create Device["D1"]`},
+			create:  base,
+		},
+		{
+			name:    "unchanged",
+			cached:  base,
+			desired: base,
+		},
+		{
+			name:    "node attribute",
+			cached:  base,
+			desired: `{"Hbt":30,"Device":{"D1":{"Name":"d1","Desc":"old","Tag":{"T1":{"Type":1,"SH":100}}}}}`,
+			changes: []string{`Update Node [Hbt]`},
+			update:  `{"Hbt":30}`,
+		},
+		{
+			name:    "device attribute",
+			cached:  base,
+			desired: `{"Hbt":60,"Device":{"D1":{"Name":"d1","Desc":"new","Tag":{"T1":{"Type":1,"SH":100}}}}}`,
+			changes: []string{`Update Device["D1"] [Desc]`},
+			update:  `{"Device":{"D1":{"Desc":"new"}}}`,
+		},
+		{
+			name:    "tag attribute",
+			cached:  base,
+			desired: `{"Hbt":60,"Device":{"D1":{"Name":"d1","Desc":"old","Tag":{"T1":{"Type":1,"SH":200}}}}}`,
+			changes: []string{`Update Device["D1"].Tag["T1"] [SH]`},
+			update:  `{"Device":{"D1":{"Tag":{"T1":{"SH":200,"Type":1}}}}}`,
+		},
+		{
+			name:    "tag type",
+			cached:  base,
+			desired: `{"Hbt":60,"Device":{"D1":{"Name":"d1","Desc":"old","Tag":{"T1":{"Type":3,"SH":100}}}}}`,
+			changes: []string{`Delete Device["D1"].Tag["T1"]`, `Create Device["D1"].Tag["T1"]`},
+			create:  `{"Device":{"D1":{"Tag":{"T1":{"SH":100,"Type":3}}}}}`,
+			delete:  `{"Device":{"D1":{"Tag":{"T1":{}}}}}`,
+		},
+		{
+			name:    "added and removed",
+			cached:  `{"Hbt":60,"Device":{"D1":{"Name":"d1","Tag":{"T1":{"Type":1}}},"D3":{"Name":"d3"}}}`,
+			desired: `{"Hbt":60,"Device":{"D1":{"Name":"d1","Tag":{"T2":{"Type":2}}},"D2":{"Name":"d2"}}}`,
+			changes: []string{
+				`Create Device["D1"].Tag["T2"]`,
+				`Delete Device["D1"].Tag["T1"]`,
+				`Create Device["D2"]`,
+				`Delete Device["D3"]`,
+			},
+			create: `{"Device":{"D1":{"Tag":{"T2":{"Type":2}}},"D2":{"Name":"d2"}}}`,
+			delete: `{"Device":{"D1":{"Tag":{"T1":{}}},"D3":{}}}`,
+		},
+		{
+			name:    "missing attributes kept",
+			cached:  base,
+			desired: `{"Hbt":60,"Device":{"D1":{"Name":"d1","Tag":{"T1":{"Type":1}}}}}`,
+		},
+	}
+	decode := func(t *testing.T, s string) map[string]interface{} {
+		t.Helper()
+		m := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	encode := func(m map[string]interface{}) string {
+		if len(m) == 0 {
+			return ""
+		}
+		j, _ := json.Marshal(m)
+		return string(j)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := diffConfig(decode(t, test.desired), decode(t, test.cached))
+			var changes []string
+			for _, change := range diff.Changes {
+				changes = append(changes, change.String())
+			}
+			if strings.Join(changes, "\n") != strings.Join(test.changes, "\n") {
+				t.Errorf("changes = %q, want %q", changes, test.changes)
+			}
+			if diff.IsEmpty() != (len(test.changes) == 0) {
+				t.Errorf("IsEmpty = %v", diff.IsEmpty())
+			}
+			create := test.create
+			if create != "" {
+				create = encode(decode(t, create))
+			}
+			if got := encode(diff.create); got != create {
+				t.Errorf("create = %s, want %s", got, create)
+			}
+			if got := encode(diff.update); got != test.update {
+				t.Errorf("update = %s, want %s", got, test.update)
+			}
+			if got := encode(diff.delete); got != test.delete {
+				t.Errorf("delete = %s, want %s", got, test.delete)
+			}
+		})
+	}
+}
@@ -0,0 +1,907 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the document read by LoadConfig and written by WriteConfig.
+//
+//	node:
+//	  type: Gateway
+//	  devices:
+//	    - id: Device1
+//	      name: Device 1
+//	      tags:
+//	        - name: ATag1
+//	          type: Analog
+//	          spanHigh: 1000
+//	          engineerUnit: C
+type configFile struct {
+	Node configFileNode `yaml:"node" json:"node"`
+}
+
+type configFileNode struct {
+	Type        *string            `yaml:"type,omitempty" json:"type,omitempty"`
+	PrimaryIP   *string            `yaml:"primaryIP,omitempty" json:"primaryIP,omitempty"`
+	BackupIP    *string            `yaml:"backupIP,omitempty" json:"backupIP,omitempty"`
+	PrimaryPort *int               `yaml:"primaryPort,omitempty" json:"primaryPort,omitempty"`
+	BackupPort  *int               `yaml:"backupPort,omitempty" json:"backupPort,omitempty"`
+	Devices     []configFileDevice `yaml:"devices,omitempty" json:"devices,omitempty"`
+}
+
+type configFileDevice struct {
+	ID                  string          `yaml:"id" json:"id"`
+	Name                *string         `yaml:"name,omitempty" json:"name,omitempty"`
+	Type                *string         `yaml:"type,omitempty" json:"type,omitempty"`
+	Description         *string         `yaml:"description,omitempty" json:"description,omitempty"`
+	IP                  *string         `yaml:"ip,omitempty" json:"ip,omitempty"`
+	Port                *int            `yaml:"port,omitempty" json:"port,omitempty"`
+	ComPortNumber       *int            `yaml:"comPortNumber,omitempty" json:"comPortNumber,omitempty"`
+	RetentionPolicyName *string         `yaml:"retentionPolicyName,omitempty" json:"retentionPolicyName,omitempty"`
+	Tags                []configFileTag `yaml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+type configFileTag struct {
+	Name                  string   `yaml:"name" json:"name"`
+	Type                  string   `yaml:"type" json:"type"` // key of TagType
+	Description           *string  `yaml:"description,omitempty" json:"description,omitempty"`
+	ReadOnly              *bool    `yaml:"readOnly,omitempty" json:"readOnly,omitempty"`
+	ArraySize             *uint    `yaml:"arraySize,omitempty" json:"arraySize,omitempty"`
+	SpanHigh              *float64 `yaml:"spanHigh,omitempty" json:"spanHigh,omitempty"`
+	SpanLow               *float64 `yaml:"spanLow,omitempty" json:"spanLow,omitempty"`
+	EngineerUnit          *string  `yaml:"engineerUnit,omitempty" json:"engineerUnit,omitempty"`
+	IntegerDisplayFormat  *uint    `yaml:"integerDisplayFormat,omitempty" json:"integerDisplayFormat,omitempty"`
+	FractionDisplayFormat *uint    `yaml:"fractionDisplayFormat,omitempty" json:"fractionDisplayFormat,omitempty"`
+	State0                *string  `yaml:"state0,omitempty" json:"state0,omitempty"`
+	State1                *string  `yaml:"state1,omitempty" json:"state1,omitempty"`
+	State2                *string  `yaml:"state2,omitempty" json:"state2,omitempty"`
+	State3                *string  `yaml:"state3,omitempty" json:"state3,omitempty"`
+	State4                *string  `yaml:"state4,omitempty" json:"state4,omitempty"`
+	State5                *string  `yaml:"state5,omitempty" json:"state5,omitempty"`
+	State6                *string  `yaml:"state6,omitempty" json:"state6,omitempty"`
+	State7                *string  `yaml:"state7,omitempty" json:"state7,omitempty"`
+}
+
+func (t *configFileTag) states() []*string {
+	return []*string{t.State0, t.State1, t.State2, t.State3, t.State4, t.State5, t.State6, t.State7}
+}
+
+// configFileLine returns the line of a device, or of a tag of a device when
+// tag is not -1. device -1 is the node.
+type configFileLine func(device int, tag int) int
+
+// csvColumns of LoadConfig and WriteConfig, a device without tags is a row
+// with an empty tag. The node columns are repeated on every row, a node
+// without devices is a row with an empty device.
+var csvColumns = []string{
+	"device", "deviceName", "deviceType", "deviceDescription",
+	"deviceIP", "devicePort", "deviceComPortNumber", "deviceRetentionPolicyName",
+	"tag", "type", "description", "readOnly", "arraySize",
+	"spanHigh", "spanLow", "engineerUnit", "integerDisplayFormat", "fractionDisplayFormat",
+	"state0", "state1", "state2", "state3", "state4", "state5", "state6", "state7",
+	"nodeType", "nodePrimaryIP", "nodeBackupIP", "nodePrimaryPort", "nodeBackupPort",
+}
+
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// LoadConfigFile reads a config file, the format is taken from the
+// extension: .yaml, .yml, .json or .csv.
+func LoadConfigFile(path string) (EdgeConfig, error) {
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = ConfigFormat["YAML"]
+	case ".json":
+		format = ConfigFormat["JSON"]
+	case ".csv":
+		format = ConfigFormat["CSV"]
+	default:
+		return EdgeConfig{}, fmt.Errorf("%w: unknown config file extension %q", ErrInvalidConfig, filepath.Ext(path))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return EdgeConfig{}, err
+	}
+	defer f.Close()
+	return LoadConfig(f, format)
+}
+
+// LoadConfig builds an EdgeConfig from a YAML, JSON or CSV document, see
+// ConfigFormat. Problems are returned together as ConfigFileErrors with the
+// line they were found at.
+func LoadConfig(r io.Reader, format string) (EdgeConfig, error) {
+	var doc configFile
+	var line configFileLine
+	var err error
+	switch format {
+	case ConfigFormat["YAML"]:
+		doc, line, err = decodeConfigYAML(r)
+	case ConfigFormat["JSON"]:
+		doc, line, err = decodeConfigJSON(r)
+	case ConfigFormat["CSV"]:
+		doc, line, err = decodeConfigCSV(r)
+	default:
+		return EdgeConfig{}, fmt.Errorf("%w: unknown config format %q", ErrInvalidConfig, format)
+	}
+	if err != nil {
+		return EdgeConfig{}, err
+	}
+	if errs := validateConfigFile(doc, line); len(errs) > 0 {
+		return EdgeConfig{}, errs
+	}
+	return doc.edgeConfig(), nil
+}
+
+// WriteConfig writes config in a format LoadConfig reads back. CSV repeats
+// the node attributes on every row.
+func WriteConfig(w io.Writer, format string, config EdgeConfig) error {
+	return writeConfigFile(w, format, configFile{Node: config.Node.file()})
+}
+
+// ExportConfig writes the config cache, as acknowledged by the uploads of
+// the agent, in a format LoadConfig reads back.
+func (a *agent) ExportConfig(w io.Writer, format string) error {
+	a.cfgLock.RLock()
+	var node map[string]interface{}
+	if a.cfgCache.D.Scada != nil {
+		node = normalizeConfig(a.cfgCache.D.Scada[a.options.NodeID])
+	}
+	a.cfgLock.RUnlock()
+	return writeConfigFile(w, format, newConfigFile(node))
+}
+
+func writeConfigFile(w io.Writer, format string, doc configFile) error {
+	switch format {
+	case ConfigFormat["YAML"]:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(doc); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case ConfigFormat["JSON"]:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(doc)
+	case ConfigFormat["CSV"]:
+		return encodeConfigCSV(w, doc)
+	}
+	return fmt.Errorf("%w: unknown config format %q", ErrInvalidConfig, format)
+}
+
+func decodeConfigYAML(r io.Reader) (configFile, configFileLine, error) {
+	var doc configFile
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return doc, nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return doc, nil, yamlErrors(err)
+	}
+	if len(root.Content) == 0 {
+		return doc, nil, ConfigFileErrors{{Err: errors.New("empty config file")}}
+	}
+
+	// decode again refusing unknown fields, a yaml.Node does not check them
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil {
+		return doc, nil, yamlErrors(err)
+	}
+	return doc, yamlLines(&root), nil
+}
+
+// decodeConfigJSON reads JSON with the YAML decoder, JSON being a subset of
+// YAML, to know the line of every device and tag.
+func decodeConfigJSON(r io.Reader) (configFile, configFileLine, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return configFile{}, nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(content, &v); err != nil {
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) {
+			line := bytes.Count(content[:syntaxError.Offset], []byte("\n")) + 1
+			return configFile{}, nil, ConfigFileErrors{{Line: line, Err: err}}
+		}
+		return configFile{}, nil, ConfigFileErrors{{Err: err}}
+	}
+	return decodeConfigYAML(bytes.NewReader(content))
+}
+
+func yamlErrors(err error) error {
+	var typeError *yaml.TypeError
+	if !errors.As(err, &typeError) {
+		if m := yamlErrorLine.FindStringSubmatch(strings.TrimPrefix(err.Error(), "yaml: ")); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return ConfigFileErrors{{Line: line, Err: errors.New(m[2])}}
+		}
+		return ConfigFileErrors{{Err: err}}
+	}
+	var errs ConfigFileErrors
+	for _, message := range typeError.Errors {
+		if m := yamlErrorLine.FindStringSubmatch(message); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			errs = append(errs, &ConfigFileError{Line: line, Err: errors.New(m[2])})
+			continue
+		}
+		errs = append(errs, &ConfigFileError{Err: errors.New(message)})
+	}
+	return errs
+}
+
+func yamlValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func yamlItem(n *yaml.Node, i int) *yaml.Node {
+	if n == nil || n.Kind != yaml.SequenceNode || i >= len(n.Content) {
+		return nil
+	}
+	return n.Content[i]
+}
+
+func yamlLines(root *yaml.Node) configFileLine {
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	return func(device int, tag int) int {
+		n := yamlValue(root, "node")
+		if device >= 0 {
+			n = yamlItem(yamlValue(n, "devices"), device)
+		}
+		if tag >= 0 {
+			n = yamlItem(yamlValue(n, "tags"), tag)
+		}
+		if n == nil {
+			return 0
+		}
+		return n.Line
+	}
+}
+
+func decodeConfigCSV(r io.Reader) (configFile, configFileLine, error) {
+	var doc configFile
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return doc, nil, err
+	}
+	recordLines := csvRecordLines(content)
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return doc, nil, ConfigFileErrors{{Err: errors.New("empty config file")}}
+	}
+	if err != nil {
+		return doc, nil, csvError(err)
+	}
+	columns := make(map[string]int)
+	var errs ConfigFileErrors
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		known := false
+		for _, column := range csvColumns {
+			if strings.EqualFold(name, column) {
+				columns[column] = i
+				known = true
+			}
+		}
+		if !known {
+			errs = append(errs, &ConfigFileError{Line: 1, Err: fmt.Errorf("unknown column %q", name)})
+		}
+	}
+	if _, ok := columns["device"]; !ok {
+		errs = append(errs, &ConfigFileError{Line: 1, Err: errors.New("missing column \"device\"")})
+	}
+	if len(errs) > 0 {
+		return doc, nil, errs
+	}
+
+	var deviceLines []int
+	var tagLines [][]int
+	records := 0 // the header is record 0
+	devices := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return doc, nil, csvError(err)
+		}
+		line := 0
+		if records++; records < len(recordLines) {
+			line = recordLines[records]
+		}
+		cell := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		optional := func(column string) *string {
+			if v := cell(column); v != "" {
+				return &v
+			}
+			return nil
+		}
+
+		number := func(column string) *int {
+			v := optional(column)
+			if v == nil {
+				return nil
+			}
+			n, err := strconv.Atoi(*v)
+			if err != nil {
+				errs = append(errs, &ConfigFileError{Line: line, Err: fmt.Errorf("%s: invalid number %q", column, *v)})
+			}
+			return &n
+		}
+
+		node := &doc.Node
+		for column, field := range map[string]**string{
+			"nodeType":      &node.Type,
+			"nodePrimaryIP": &node.PrimaryIP,
+			"nodeBackupIP":  &node.BackupIP,
+		} {
+			if v := optional(column); v != nil {
+				*field = v
+			}
+		}
+		for column, field := range map[string]**int{
+			"nodePrimaryPort": &node.PrimaryPort,
+			"nodeBackupPort":  &node.BackupPort,
+		} {
+			if v := number(column); v != nil {
+				*field = v
+			}
+		}
+
+		deviceID := cell("device")
+		if deviceID == "" && cell("tag") == "" && cell("type") == "" {
+			continue
+		}
+		index, ok := devices[deviceID]
+		if !ok {
+			index = len(doc.Node.Devices)
+			devices[deviceID] = index
+			doc.Node.Devices = append(doc.Node.Devices, configFileDevice{ID: deviceID})
+			deviceLines = append(deviceLines, line)
+			tagLines = append(tagLines, nil)
+		}
+		device := &doc.Node.Devices[index]
+		for column, field := range map[string]**string{
+			"deviceName":                &device.Name,
+			"deviceType":                &device.Type,
+			"deviceDescription":         &device.Description,
+			"deviceIP":                  &device.IP,
+			"deviceRetentionPolicyName": &device.RetentionPolicyName,
+		} {
+			if v := optional(column); v != nil {
+				*field = v
+			}
+		}
+		for column, field := range map[string]**int{
+			"devicePort":          &device.Port,
+			"deviceComPortNumber": &device.ComPortNumber,
+		} {
+			if v := number(column); v != nil {
+				*field = v
+			}
+		}
+		if cell("tag") == "" && cell("type") == "" {
+			continue
+		}
+
+		tag := configFileTag{
+			Name:         cell("tag"),
+			Type:         cell("type"),
+			Description:  optional("description"),
+			EngineerUnit: optional("engineerUnit"),
+			State0:       optional("state0"),
+			State1:       optional("state1"),
+			State2:       optional("state2"),
+			State3:       optional("state3"),
+			State4:       optional("state4"),
+			State5:       optional("state5"),
+			State6:       optional("state6"),
+			State7:       optional("state7"),
+		}
+		if v := optional("readOnly"); v != nil {
+			b, err := strconv.ParseBool(*v)
+			if err != nil {
+				errs = append(errs, &ConfigFileError{Line: line, Err: fmt.Errorf("readOnly: invalid bool %q", *v)})
+			}
+			tag.ReadOnly = &b
+		}
+		for column, field := range map[string]**uint{
+			"arraySize":             &tag.ArraySize,
+			"integerDisplayFormat":  &tag.IntegerDisplayFormat,
+			"fractionDisplayFormat": &tag.FractionDisplayFormat,
+		} {
+			if v := optional(column); v != nil {
+				n, err := strconv.ParseUint(*v, 10, 32)
+				if err != nil {
+					errs = append(errs, &ConfigFileError{Line: line, Err: fmt.Errorf("%s: invalid number %q", column, *v)})
+				}
+				u := uint(n)
+				*field = &u
+			}
+		}
+		for column, field := range map[string]**float64{
+			"spanHigh": &tag.SpanHigh,
+			"spanLow":  &tag.SpanLow,
+		} {
+			if v := optional(column); v != nil {
+				f, err := strconv.ParseFloat(*v, 64)
+				if err != nil {
+					errs = append(errs, &ConfigFileError{Line: line, Err: fmt.Errorf("%s: invalid number %q", column, *v)})
+				}
+				*field = &f
+			}
+		}
+		device.Tags = append(device.Tags, tag)
+		tagLines[index] = append(tagLines[index], line)
+	}
+	line := func(device int, tag int) int {
+		switch {
+		case device < 0:
+			return 0
+		case tag < 0:
+			return deviceLines[device]
+		}
+		return tagLines[device][tag]
+	}
+	if len(errs) > 0 {
+		// report the problems of the other rows as well
+		errs = append(errs, validateConfigFile(doc, line)...)
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+		return doc, nil, errs
+	}
+	return doc, line, nil
+}
+
+// csvRecordLines returns the line every record of content starts at, the
+// way csv.Reader reads it, skipping empty lines. csv.Reader.FieldPos needs
+// Go 1.17.
+func csvRecordLines(content []byte) []int {
+	var lines []int
+	line := 1
+	start := true
+	quoted := false
+	for _, c := range content {
+		if start {
+			if c == '\r' {
+				continue
+			}
+			if c == '\n' {
+				line++
+				continue
+			}
+			lines = append(lines, line)
+			start = false
+		}
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '\n':
+			line++
+			start = !quoted
+		}
+	}
+	return lines
+}
+
+func csvError(err error) error {
+	var parseError *csv.ParseError
+	if errors.As(err, &parseError) {
+		return ConfigFileErrors{{Line: parseError.Line, Err: parseError.Err}}
+	}
+	return ConfigFileErrors{{Err: err}}
+}
+
+func encodeConfigCSV(w io.Writer, doc configFile) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvColumns); err != nil {
+		return err
+	}
+	str := func(v *string) string {
+		if v == nil {
+			return ""
+		}
+		return *v
+	}
+	num := func(v *uint) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(*v), 10)
+	}
+	float := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+	integer := func(v *int) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.Itoa(*v)
+	}
+	node := doc.Node
+	nodeColumns := []string{str(node.Type), str(node.PrimaryIP), str(node.BackupIP), integer(node.PrimaryPort), integer(node.BackupPort)}
+	devices := node.Devices
+	if len(devices) == 0 && strings.Join(nodeColumns, "") != "" {
+		devices = []configFileDevice{{}}
+	}
+	for _, device := range devices {
+		row := []string{device.ID, str(device.Name), str(device.Type), str(device.Description),
+			str(device.IP), integer(device.Port), integer(device.ComPortNumber), str(device.RetentionPolicyName)}
+		if len(device.Tags) == 0 {
+			record := append(append(row, make([]string, len(csvColumns)-len(row)-len(nodeColumns))...), nodeColumns...)
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, tag := range device.Tags {
+			readOnly := ""
+			if tag.ReadOnly != nil {
+				readOnly = strconv.FormatBool(*tag.ReadOnly)
+			}
+			record := append(append([]string{}, row...),
+				tag.Name, tag.Type, str(tag.Description), readOnly, num(tag.ArraySize),
+				float(tag.SpanHigh), float(tag.SpanLow), str(tag.EngineerUnit),
+				num(tag.IntegerDisplayFormat), num(tag.FractionDisplayFormat))
+			for _, state := range tag.states() {
+				record = append(record, str(state))
+			}
+			record = append(record, nodeColumns...)
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func validateConfigFile(doc configFile, line configFileLine) ConfigFileErrors {
+	var errs ConfigFileErrors
+	doc.validate(func(device int, tag int, err error) {
+		prefix := "node: "
+		if device >= 0 {
+			prefix = configFileName("device", doc.Node.Devices[device].ID)
+		}
+		if tag >= 0 {
+			prefix += configFileName("tag", doc.Node.Devices[device].Tags[tag].Name)
+		}
+		errs = append(errs, &ConfigFileError{Line: line(device, tag), Err: fmt.Errorf("%s%v", prefix, err)})
+	})
+	return errs
+}
+
+func configFileName(kind string, name string) string {
+	if name == "" {
+		return kind + ": "
+	}
+	return fmt.Sprintf("%s %q: ", kind, name)
+}
+
+// validate reports every problem of the document, device and tag are the
+// indexes of the device and tag it was found at, -1 for the node or device.
+func (doc configFile) validate(report func(device int, tag int, err error)) {
+	node := doc.Node
+	if node.Type != nil {
+		if _, ok := EdgeType[*node.Type]; !ok {
+			report(-1, -1, fmt.Errorf("unknown edge type %q", *node.Type))
+		}
+	}
+	for _, port := range []*int{node.PrimaryPort, node.BackupPort} {
+		if port != nil && (*port < 0 || *port > 65535) {
+			report(-1, -1, fmt.Errorf("port %d out of range", *port))
+		}
+	}
+
+	devices := make(map[string]bool)
+	for i, device := range node.Devices {
+		switch {
+		case device.ID == "":
+			report(i, -1, errors.New("missing id"))
+		case devices[device.ID]:
+			report(i, -1, errors.New("duplicate id"))
+		}
+		devices[device.ID] = true
+		if device.Port != nil && (*device.Port < 0 || *device.Port > 65535) {
+			report(i, -1, fmt.Errorf("port %d out of range", *device.Port))
+		}
+
+		tags := make(map[string]bool)
+		for j, tag := range device.Tags {
+			switch {
+			case tag.Name == "":
+				report(i, j, errors.New("missing name"))
+				continue
+			case tags[tag.Name]:
+				report(i, j, errors.New("duplicate name"))
+			}
+			tags[tag.Name] = true
+
+			for _, err := range tag.validate() {
+				report(i, j, err)
+			}
+		}
+	}
+}
+
+func (t configFileTag) validate() []error {
+	tagType, ok := TagType[t.Type]
+	if !ok {
+		return []error{fmt.Errorf("unknown tag type %q", t.Type)}
+	}
+	var errs []error
+	analog := t.SpanHigh != nil || t.SpanLow != nil || t.EngineerUnit != nil ||
+		t.IntegerDisplayFormat != nil || t.FractionDisplayFormat != nil
+	if analog && tagType != TagType["Analog"] {
+		errs = append(errs, errors.New("span, unit and display format are only allowed on Analog tags"))
+	}
+	for _, state := range t.states() {
+		if state != nil && tagType != TagType["Discrete"] {
+			errs = append(errs, errors.New("states are only allowed on Discrete tags"))
+			break
+		}
+	}
+	if t.SpanHigh != nil && t.SpanLow != nil && *t.SpanLow > *t.SpanHigh {
+		errs = append(errs, fmt.Errorf("spanLow %v is above spanHigh %v", *t.SpanLow, *t.SpanHigh))
+	}
+	return errs
+}
+
+func (doc configFile) edgeConfig() EdgeConfig {
+	return EdgeConfig{Node: doc.Node.nodeConfig()}
+}
+
+func (n configFileNode) nodeConfig() NodeConfig {
+	node := NewNodeConfig()
+	if n.Type != nil {
+		node.SetType(EdgeType[*n.Type])
+	}
+	if n.PrimaryIP != nil {
+		node.SetPrimaryIP(*n.PrimaryIP)
+	}
+	if n.BackupIP != nil {
+		node.SetBackupIP(*n.BackupIP)
+	}
+	if n.PrimaryPort != nil {
+		node.SetPrimaryPort(*n.PrimaryPort)
+	}
+	if n.BackupPort != nil {
+		node.SetBackupPort(*n.BackupPort)
+	}
+	for _, d := range n.Devices {
+		node.DeviceList = append(node.DeviceList, d.deviceConfig())
+	}
+	return node
+}
+
+func (d configFileDevice) deviceConfig() DeviceConfig {
+	device := NewDeviceConfig(d.ID)
+	if d.Name != nil {
+		device.SetName(*d.Name)
+	}
+	if d.Type != nil {
+		device.SetType(*d.Type)
+	}
+	if d.Description != nil {
+		device.SetDescription(*d.Description)
+	}
+	if d.IP != nil {
+		device.SetIP(*d.IP)
+	}
+	if d.Port != nil {
+		device.SetPort(*d.Port)
+	}
+	if d.ComPortNumber != nil {
+		device.SetComPortNumber(*d.ComPortNumber)
+	}
+	if d.RetentionPolicyName != nil {
+		device.SetRetentionPolicyName(*d.RetentionPolicyName)
+	}
+
+	for _, t := range d.Tags {
+		switch TagType[t.Type] {
+		case TagType["Analog"]:
+			device.AnalogTagList = append(device.AnalogTagList, t.analogTagConfig())
+		case TagType["Discrete"]:
+			device.DiscreteTagList = append(device.DiscreteTagList, t.discreteTagConfig())
+		case TagType["Text"]:
+			device.TextTagList = append(device.TextTagList, t.textTagConfig())
+		}
+	}
+	return device
+}
+
+func (t configFileTag) analogTagConfig() AnalogTagConfig {
+	tag := NewAnaglogTagConfig(t.Name)
+	t.setTagConfig(&tag.description, &tag.readOnly, &tag.arraySize)
+	if t.SpanHigh != nil {
+		tag.SetSpanHigh(*t.SpanHigh)
+	}
+	if t.SpanLow != nil {
+		tag.SetSpanLow(*t.SpanLow)
+	}
+	if t.EngineerUnit != nil {
+		tag.SetEngineerUnit(*t.EngineerUnit)
+	}
+	if t.IntegerDisplayFormat != nil {
+		tag.SetIntegerDisplayFormat(*t.IntegerDisplayFormat)
+	}
+	if t.FractionDisplayFormat != nil {
+		tag.SetFractionDisplayFormat(*t.FractionDisplayFormat)
+	}
+	return tag
+}
+
+func (t configFileTag) discreteTagConfig() DiscreteTagConfig {
+	tag := NewDiscreteTagConfig(t.Name)
+	t.setTagConfig(&tag.description, &tag.readOnly, &tag.arraySize)
+	states := []*interface{}{&tag.state0, &tag.state1, &tag.state2, &tag.state3, &tag.state4, &tag.state5, &tag.state6, &tag.state7}
+	for i, state := range t.states() {
+		if state != nil {
+			*states[i] = *state
+		}
+	}
+	return tag
+}
+
+func (t configFileTag) textTagConfig() TextTagConfig {
+	tag := NewTextTagConfig(t.Name)
+	t.setTagConfig(&tag.description, &tag.readOnly, &tag.arraySize)
+	return tag
+}
+
+func (t configFileTag) setTagConfig(description *interface{}, readOnly *interface{}, arraySize *interface{}) {
+	if t.Description != nil {
+		*description = *t.Description
+	}
+	if t.ReadOnly != nil {
+		*readOnly = *t.ReadOnly
+	}
+	if t.ArraySize != nil {
+		*arraySize = *t.ArraySize
+	}
+}
+
+// newConfigFile builds the document from a normalized node of the config
+// cache, devices and tags sorted by id and name.
+func newConfigFile(node map[string]interface{}) configFile {
+	var doc configFile
+	if t, ok := cfgNumber(node["Type"]); ok {
+		for name, value := range EdgeType {
+			if float64(value) == t {
+				nodeType := name
+				doc.Node.Type = &nodeType
+			}
+		}
+	}
+	doc.Node.PrimaryIP = cfgString(node["PIP"])
+	doc.Node.BackupIP = cfgString(node["BIP"])
+	doc.Node.PrimaryPort = cfgInt(node["PPort"])
+	doc.Node.BackupPort = cfgInt(node["BPort"])
+
+	devices := childMap(node, "Device")
+	for _, deviceID := range sortedKeys(devices) {
+		d := childMap(devices, deviceID)
+		device := configFileDevice{
+			ID:                  deviceID,
+			Name:                cfgString(d["Name"]),
+			Type:                cfgString(d["Type"]),
+			Description:         cfgString(d["Desc"]),
+			IP:                  cfgString(d["IP"]),
+			Port:                cfgInt(d["Port"]),
+			ComPortNumber:       cfgInt(d["PNbr"]),
+			RetentionPolicyName: cfgString(d["RP"]),
+		}
+		tags := childMap(d, "Tag")
+		for _, tagName := range sortedKeys(tags) {
+			t := childMap(tags, tagName)
+			tag := configFileTag{
+				Name:                  tagName,
+				Description:           cfgString(t["Desc"]),
+				ArraySize:             cfgUint(t["Ary"]),
+				SpanHigh:              cfgFloat(t["SH"]),
+				SpanLow:               cfgFloat(t["SL"]),
+				EngineerUnit:          cfgString(t["EU"]),
+				IntegerDisplayFormat:  cfgUint(t["IDF"]),
+				FractionDisplayFormat: cfgUint(t["FDF"]),
+				State0:                cfgString(t["S0"]),
+				State1:                cfgString(t["S1"]),
+				State2:                cfgString(t["S2"]),
+				State3:                cfgString(t["S3"]),
+				State4:                cfgString(t["S4"]),
+				State5:                cfgString(t["S5"]),
+				State6:                cfgString(t["S6"]),
+				State7:                cfgString(t["S7"]),
+			}
+			if v, ok := cfgNumber(t["Type"]); ok {
+				for name, value := range TagType {
+					if float64(value) == v {
+						tag.Type = name
+					}
+				}
+			}
+			if v, ok := cfgNumber(t["RO"]); ok {
+				readOnly := v != 0
+				tag.ReadOnly = &readOnly
+			}
+			device.Tags = append(device.Tags, tag)
+		}
+		doc.Node.Devices = append(doc.Node.Devices, device)
+	}
+	return doc
+}
+
+func cfgNumber(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func cfgString(v interface{}) *string {
+	if s, ok := v.(string); ok {
+		return &s
+	}
+	return nil
+}
+
+func cfgFloat(v interface{}) *float64 {
+	if f, ok := cfgNumber(v); ok {
+		return &f
+	}
+	return nil
+}
+
+func cfgInt(v interface{}) *int {
+	if f, ok := cfgNumber(v); ok {
+		i := int(f)
+		return &i
+	}
+	return nil
+}
+
+func cfgUint(v interface{}) *uint {
+	if f, ok := cfgNumber(v); ok && f >= 0 {
+		u := uint(f)
+		return &u
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func configFileTestConfig() EdgeConfig {
+	config := EdgeConfig{Node: NewNodeConfig()}
+	config.Node.SetType(EdgeType["Gateway"])
+	config.Node.SetPrimaryIP("10.0.0.1")
+	config.Node.SetPrimaryPort(1883)
+
+	device := NewDeviceConfig("Device1")
+	device.SetName("Device 1")
+	device.SetType("Smart Device")
+	device.SetDescription("line one\nline two")
+	device.SetIP("10.0.0.2")
+	device.SetPort(502)
+	analog := NewAnaglogTagConfig("ATag1")
+	analog.SetSpanHigh(1000)
+	analog.SetSpanLow(-1.5)
+	analog.SetEngineerUnit("C")
+	analog.SetFractionDisplayFormat(2)
+	analog.SetArraySize(3)
+	device.AnalogTagList = append(device.AnalogTagList, analog)
+	discrete := NewDiscreteTagConfig("DTag1")
+	discrete.SetReadOnly(true)
+	discrete.SetState0("off")
+	discrete.SetState7("alarm")
+	device.DiscreteTagList = append(device.DiscreteTagList, discrete)
+	text := NewTextTagConfig("TTag1")
+	text.SetDescription("a, \"quoted\" text")
+	device.TextTagList = append(device.TextTagList, text)
+	config.Node.DeviceList = append(config.Node.DeviceList, device)
+
+	empty := NewDeviceConfig("Device2")
+	empty.SetComPortNumber(3)
+	config.Node.DeviceList = append(config.Node.DeviceList, empty)
+	return config
+}
+
+func TestConfigFileRoundTrip(t *testing.T) {
+	config := configFileTestConfig()
+	for _, format := range []string{ConfigFormat["YAML"], ConfigFormat["JSON"], ConfigFormat["CSV"]} {
+		t.Run(format, func(t *testing.T) {
+			var written bytes.Buffer
+			if err := WriteConfig(&written, format, config); err != nil {
+				t.Fatalf("WriteConfig: %v", err)
+			}
+			loaded, err := LoadConfig(bytes.NewReader(written.Bytes()), format)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v\n%s", err, written.String())
+			}
+			if !loaded.Equal(config) {
+				t.Fatalf("loaded config differs:\n%s", written.String())
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		errors  []string
+	}{
+		{
+			name:   "yaml tag",
+			format: ConfigFormat["YAML"],
+			content: `node:
+  type: Gateway
+  devices:
+    - id: Device1
+      tags:
+        - name: ATag1
+          type: Analog
+        - name: BTag1
+          type: Unknown
+`,
+			errors: []string{`line 8: device "Device1": tag "BTag1": unknown tag type "Unknown"`},
+		},
+		{
+			name:   "yaml devices",
+			format: ConfigFormat["YAML"],
+			content: `node:
+  type: Cloud
+  devices:
+    - id: Device1
+    - id: Device1
+      port: 70000
+`,
+			errors: []string{
+				`line 2: node: unknown edge type "Cloud"`,
+				`line 5: device "Device1": duplicate id`,
+				`line 5: device "Device1": port 70000 out of range`,
+			},
+		},
+		{
+			name:   "yaml unknown field",
+			format: ConfigFormat["YAML"],
+			content: `node:
+  devices:
+    - id: Device1
+      colour: red
+`,
+			errors: []string{`line 4: field colour not found in type agent.configFileDevice`},
+		},
+		{
+			name:    "yaml syntax",
+			format:  ConfigFormat["YAML"],
+			content: "node:\n  devices:\n\t- id: Device1\n",
+			errors:  []string{`line 3: found character that cannot start any token`},
+		},
+		{
+			name:   "json tag",
+			format: ConfigFormat["JSON"],
+			content: `{
+  "node": {
+    "devices": [
+      {
+        "id": "Device1",
+        "tags": [
+          {"name": "DTag1", "type": "Discrete", "spanHigh": 1}
+        ]
+      }
+    ]
+  }
+}`,
+			errors: []string{`line 7: device "Device1": tag "DTag1": span, unit and display format are only allowed on Analog tags`},
+		},
+		{
+			name:    "json syntax",
+			format:  ConfigFormat["JSON"],
+			content: "{\n  \"node\": {\n    \"devices\": [}\n}",
+			errors:  []string{`line 3: invalid character '}' looking for beginning of value`},
+		},
+		{
+			name:    "csv columns",
+			format:  ConfigFormat["CSV"],
+			content: "tag,colour\nATag1,red\n",
+			errors:  []string{`line 1: unknown column "colour"`, `line 1: missing column "device"`},
+		},
+		{
+			name:   "csv rows",
+			format: ConfigFormat["CSV"],
+			content: "device,deviceDescription,tag,type\n" +
+				"Device1,\"two\nlines\",ATag1,Analog\n" +
+				"\n" +
+				"Device1,,TTag1,Text\n" +
+				"Device1,,TTag1,Unknown\n",
+			errors: []string{`line 6: device "Device1": tag "TTag1": duplicate name`, `line 6: device "Device1": tag "TTag1": unknown tag type "Unknown"`},
+		},
+		{
+			name:    "csv syntax",
+			format:  ConfigFormat["CSV"],
+			content: "device,tag\nDevice1,A\"Tag\n",
+			errors:  []string{`line 2: bare " in non-quoted-field`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadConfig(strings.NewReader(test.content), test.format)
+			var errs ConfigFileErrors
+			if !errors.As(err, &errs) || !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("LoadConfig = %v, want ConfigFileErrors", err)
+			}
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(test.errors, "\n") {
+				t.Fatalf("errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.errors, "\n"))
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileExtension(t *testing.T) {
+	if _, err := LoadConfigFile("config.txt"); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("LoadConfigFile = %v, want ErrInvalidConfig", err)
+	}
+}
@@ -1,5 +1,9 @@
 package agent
 
+import (
+	"os"
+)
+
 const (
 	// tag key for map
 	tagKeyFormat string = "%s|%s|%s"
@@ -11,8 +15,26 @@ const (
 	dataRecoverInterval int = 3 //second
 	// dataRecoverFilePath ...
 	dataRecoverFilePath string = "recover.sqlite"
+	// dataRecoverJournalPath ...
+	dataRecoverJournalPath string = "recover.journal"
+	// defaultMemoryRecoverRows ...
+	defaultMemoryRecoverRows int = 10000
 	// tags conifg file path
 	tagsCfgFilePath string = "cfgCache.json"
+	// tagsCfgFingerprintSuffix of the file next to the config cache
+	tagsCfgFingerprintSuffix string = ".sha256"
+	// defaultConfigAckTimeout ...
+	defaultConfigAckTimeout int = 30 // second
+	// dccsRequestTimeout ...
+	dccsRequestTimeout int = 30 // second
+	// defaultFileMode of recover and config cache files
+	defaultFileMode os.FileMode = 0644
+	// defaultDirMode of the state directory
+	defaultDirMode os.FileMode = 0755
+	// defaultAsyncQueueSize ...
+	defaultAsyncQueueSize int = 10000 // tag values
+	// defaultAsyncBatchWindow ...
+	defaultAsyncBatchWindow int = 1000 // millisecond
 	// limit data size
 	dataMaxTagCount int = 100
 )
@@ -54,15 +76,17 @@ var mqttQoS = map[string]byte{
 
 // Protocol ...
 var Protocol = map[string]string{
-	"TCP":       "tcp",
-	"WebSocket": "websockets",
-	"TLS":       "tls",
+	"TCP":             "tcp",
+	"WebSocket":       "websockets",
+	"TLS":             "tls",
+	"SecureWebSocket": "securewebsockets",
 }
 
 var protocolScheme = map[string]string{
-	"tcp":        "tcp",
-	"websockets": "ws",
-	"tls":        "tls",
+	"tcp":              "tcp",
+	"websockets":       "ws",
+	"tls":              "tls",
+	"securewebsockets": "wss",
 }
 
 // Status ...
@@ -71,6 +95,47 @@ var Status = map[string]byte{
 	"Online":  1,
 }
 
+// DataRecoverType ...
+var DataRecoverType = map[string]string{
+	"SQLite": "sqlite",
+	"File":   "file",
+	"Memory": "memory",
+}
+
+// ConfigFormat of LoadConfig, WriteConfig and ExportConfig
+var ConfigFormat = map[string]string{
+	"YAML": "yaml",
+	"JSON": "json",
+	"CSV":  "csv",
+}
+
+// DataValidation of SendData values against the uploaded config
+var DataValidation = map[string]byte{
+	"None":   0,
+	"Report": 1, // logs invalid tag values and sends them
+	"Drop":   2, // logs invalid tag values and removes them
+}
+
+// FractionConvert of analog values to the FractionDisplayFormat of the tag
+var FractionConvert = map[string]byte{
+	"None":     0,
+	"Round":    1,
+	"Truncate": 2,
+}
+
+// BackPressure of the asynchronous SendData when its queue is full
+var BackPressure = map[string]byte{
+	"Block": 0, // waits for room until the context is done
+	"Drop":  1, // drops the data and returns ErrQueueFull
+	"Spill": 2, // writes the data to the DataRecoverHelper
+}
+
+// DropPolicy ...
+var DropPolicy = map[string]byte{
+	"DropOldest": 0,
+	"DropNewest": 1,
+}
+
 // TagType ...
 var TagType = map[string]byte{
 	"Analog":   1,
@@ -1,9 +1,12 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 func convertCreateorUpdateConfig(action byte, nodeID string, config EdgeConfig, heartbeat int) (bool, configMessage) {
@@ -200,43 +203,164 @@ func convertTextTagConfig(tag TextTagConfig) (string, map[string]interface{}) {
 	return tag.name.(string), t
 }
 
-func convertTagValue(data EdgeData, a *agent) (bool, []string) {
+// convertTagValue splits data into payloads of at most MaxTagsPerMessage
+// tags and MaxMessageBytes bytes. The tag values left out, because they
+// cannot be encoded or alone exceed MaxMessageBytes, are returned as errors.
+func convertTagValue(data EdgeData, a *agent) ([]string, []*TagValueError) {
 	count := 0
 	list := data.TagList
 	var messages []string
+	var rejected []*TagValueError
 	msg := newTagValue(data.Timestamp)
 
+	maxTags := a.options.MaxTagsPerMessage
+	if maxTags <= 0 {
+		maxTags = dataMaxTagCount
+	}
+	maxBytes := a.options.MaxMessageBytes
+	base := len(msg.getPayload()) // {"ts":"...","d":{}}
+	size := base
+
+	var devices map[string]interface{}
+	if a.options.FractionConvert != FractionConvert["None"] {
+		a.cfgLock.RLock()
+		defer a.cfgLock.RUnlock()
+		if node, ok := a.cfgCache.D.Scada[a.options.NodeID].(map[string]interface{}); ok {
+			devices = childMap(node, "Device")
+		}
+	}
+
 	sort.Slice(list[:], func(i, j int) bool {
 		return list[i].DeviceID < list[j].DeviceID
 	})
 
 	for _, tag := range list {
+		value := tag.Value
+		if devices != nil {
+			config := childMap(childMap(childMap(devices, tag.DeviceID), "Tag"), tag.TagName)
+			tagType, _ := cfgNumber(config["Type"])
+			fractionDisplayFormat, ok := cfgNumber(config["FDF"])
+			if ok && byte(tagType) == TagType["Analog"] {
+				value = convertByFDF(value, int(fractionDisplayFormat), a.options.FractionConvert == FractionConvert["Truncate"])
+			}
+		}
+
+		// encoded size of "tag":value, and of "device":{}, with their commas
+		tagBytes, err := encodedSize(tag.TagName, value)
+		if err != nil {
+			a.logger.Error("encode tag value failed", "deviceID", tag.DeviceID, "tagName", tag.TagName, "error", err)
+			rejected = append(rejected, &TagValueError{DeviceID: tag.DeviceID, TagName: tag.TagName, Err: err})
+			continue
+		}
+		deviceBytes, _ := encodedSize(tag.DeviceID, struct{}{})
+		if maxBytes > 0 && base+deviceBytes+tagBytes > maxBytes {
+			a.logger.Error("tag value exceeds the message size limit", "deviceID", tag.DeviceID, "tagName", tag.TagName, "bytes", base+deviceBytes+tagBytes, "limit", maxBytes)
+			rejected = append(rejected, &TagValueError{DeviceID: tag.DeviceID, TagName: tag.TagName, Err: ErrMessageTooLarge})
+			continue
+		}
+
+		if msg.D[tag.DeviceID] != nil {
+			deviceBytes = 0
+		}
+		if count > 0 && (count >= maxTags || maxBytes > 0 && size+deviceBytes+tagBytes > maxBytes) {
+			messages = append(messages, msg.getPayload())
+			msg = newTagValue(data.Timestamp)
+			size = base
+			count = 0
+			deviceBytes, _ = encodedSize(tag.DeviceID, struct{}{})
+		}
 
 		if msg.D[tag.DeviceID] == nil {
 			msg.D[tag.DeviceID] = make(map[string]interface{})
 		}
+		msg.D[tag.DeviceID].(map[string]interface{})[tag.TagName] = value
+		size += deviceBytes + tagBytes
+		count++
+	}
+	// an empty TagList still sends an empty payload, rejected tags do not
+	if count > 0 || len(list) == 0 {
+		messages = append(messages, msg.getPayload())
+	}
+	return messages, rejected
+}
 
-		// :: Unsupported FDF convert in v1.0.5
-		// fractionDisplayFormat, ok := a.cfgCache.D.Scada[a.options.NodeID].(map[string]interface{})["Device"].(map[string]interface{})[tag.DeviceID].(map[string]interface{})["Tag"].(map[string]interface{})[tag.TagName].(map[string]interface{})["FDF"]
-
-		// if ok == true {
-		// 	// Round down tag value to the specified digit
-		// 	convertVal := roundDownByFDF(tag.Value, fractionDisplayFormat)
-		// 	msg.D[tag.DeviceID].(map[string]interface{})[tag.TagName] = convertVal
-		// } else {
-		// 	msg.D[tag.DeviceID].(map[string]interface{})[tag.TagName] = tag.Value
-		// }
+// encodedSize returns the length of "key":value, in JSON.
+func encodedSize(key string, value interface{}) (int, error) {
+	k, err := json.Marshal(key)
+	if err != nil {
+		return 0, err
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+	return len(k) + 1 + len(v) + 1, nil
+}
 
-		msg.D[tag.DeviceID].(map[string]interface{})[tag.TagName] = tag.Value
+// convertByFDF rounds or truncates a float value, or every float of an
+// array value, to fractionDisplayFormat digits. Other values are returned
+// as they are.
+func convertByFDF(value interface{}, fractionDisplayFormat int, truncate bool) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if truncate {
+			return truncateByFDF(v, fractionDisplayFormat)
+		}
+		return roundDownByFDF(v, fractionDisplayFormat)
+	case float32:
+		// keep the shortest decimal form, float64(float32(1.15)) is 1.149999976
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return convertByFDF(f, fractionDisplayFormat, truncate)
+	case AnalogArray:
+		values := make(AnalogArray, len(v))
+		for i := range v {
+			values[i] = convertByFDF(v[i], fractionDisplayFormat, truncate).(float64)
+		}
+		return values
+	case ArrayUpdate:
+		values := make(ArrayUpdate, len(v))
+		for index, value := range v {
+			values[index] = convertByFDF(value, fractionDisplayFormat, truncate)
+		}
+		return values
+	}
 
-		count++
-		if count == dataMaxTagCount {
-			messages = append(messages, msg.getPayload())
-			msg = newTagValue(data.Timestamp)
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return convertByFDF(v.Float(), fractionDisplayFormat, truncate)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return value
 		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = convertByFDF(v.Index(i).Interface(), fractionDisplayFormat, truncate)
+		}
+		return values
+	case reflect.Map:
+		values := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			values[fmt.Sprint(iter.Key().Interface())] = convertByFDF(iter.Value().Interface(), fractionDisplayFormat, truncate)
+		}
+		return values
+	}
+	return value
+}
+
+func truncateByFDF(originVal float64, fractionDisplayFormat int) float64 {
+	valStr := strconv.FormatFloat(originVal, 'f', -1, 64)
+	if i := strings.IndexByte(valStr, '.'); i >= 0 && len(valStr)-i-1 > fractionDisplayFormat {
+		valStr = valStr[:i+1+fractionDisplayFormat]
 	}
-	messages = append(messages, msg.getPayload())
-	return true, messages
+
+	finalVal, err := strconv.ParseFloat(strings.TrimSuffix(valStr, "."), 64)
+	if err != nil {
+		return originVal
+	}
+
+	return finalVal
 }
 
 func roundDownByFDF(originVal interface{}, fractionDisplayFormat interface{}) float64 {
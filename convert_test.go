@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvertTagValueSizeLimit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	options := NewEdgeAgentOptions()
+	options.NodeID = "node1"
+	options.StateDir = dir
+	options.Transport = NewMemoryTransport()
+	options.Logger = NewNopLogger()
+	options.FractionConvert = FractionConvert["Round"]
+	a := NewAgent(options).(*agent)
+
+	config := EdgeConfig{Node: NewNodeConfig()}
+	var tags []EdgeTag
+	for d := 0; d < 3; d++ {
+		deviceID := fmt.Sprintf("Device-%d-%s", d, strings.Repeat("x", d*10))
+		device := NewDeviceConfig(deviceID)
+		for i := 0; i < 20; i++ {
+			tag := NewAnaglogTagConfig(fmt.Sprintf("Tag%d", i))
+			tag.SetFractionDisplayFormat(uint(i % 3))
+			device.AnalogTagList = append(device.AnalogTagList, tag)
+			tags = append(tags, EdgeTag{DeviceID: deviceID, TagName: fmt.Sprintf("Tag%d", i), Value: 123.456789 * float64(i)})
+		}
+		config.Node.DeviceList = append(config.Node.DeviceList, device)
+	}
+	message, err := a.convertConfig(Action["Create"], config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.applyConfig(message)
+
+	ts := time.Date(2026, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	for limit := 110; limit <= 600; limit += 7 {
+		a.options.MaxMessageBytes = limit
+		data := EdgeData{Timestamp: ts, TagList: append([]EdgeTag(nil), tags...)}
+		payloads, rejected := convertTagValue(data, a)
+		if len(rejected) != 0 {
+			t.Fatalf("limit %d: rejected %v", limit, rejected[0])
+		}
+		seen := 0
+		for _, payload := range payloads {
+			if len(payload) > limit {
+				t.Fatalf("limit %d: payload of %d bytes: %s", limit, len(payload), payload)
+			}
+			var msg struct {
+				D map[string]map[string]float64 `json:"d"`
+			}
+			if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+				t.Fatalf("limit %d: %v", limit, err)
+			}
+			for _, values := range msg.D {
+				seen += len(values)
+			}
+		}
+		if seen != len(tags) {
+			t.Fatalf("limit %d: %d tag values in the payloads, want %d", limit, seen, len(tags))
+		}
+	}
+}
+
+func TestConvertTagValueRejected(t *testing.T) {
+	options := NewEdgeAgentOptions()
+	options.Logger = NewNopLogger()
+	options.Transport = NewMemoryTransport()
+	options.DataRecover = false
+	options.MaxMessageBytes = 100
+	a := NewAgent(options).(*agent)
+
+	data := EdgeData{Timestamp: time.Now(), TagList: []EdgeTag{
+		{DeviceID: "Device1", TagName: "Big", Value: strings.Repeat("x", 100)},
+		{DeviceID: "Device1", TagName: "NaN", Value: math.NaN()},
+		{DeviceID: "Device1", TagName: "Ok", Value: 1},
+	}}
+	payloads, rejected := convertTagValue(data, a)
+	if len(payloads) != 1 || !strings.Contains(payloads[0], `"Ok":1`) {
+		t.Fatalf("payloads = %q", payloads)
+	}
+	errs := make(map[string]error)
+	for _, err := range rejected {
+		errs[err.TagName] = err
+	}
+	if len(rejected) != 2 || !errors.Is(errs["Big"], ErrMessageTooLarge) ||
+		errs["NaN"] == nil || errors.Is(errs["NaN"], ErrMessageTooLarge) {
+		t.Fatalf("rejected = %v", rejected)
+	}
+
+	result, err := a.publishData(context.Background(), nil, data, SendResult{})
+	var tagErr *TagValueError
+	if !errors.As(err, &tagErr) || result.Rejected != 2 || result.Dropped != 1 {
+		t.Fatalf("publishData = %+v, %v", result, err)
+	}
+}
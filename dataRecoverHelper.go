@@ -2,10 +2,11 @@ package agent
 
 import (
 	"database/sql"
-	"fmt"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -17,145 +18,409 @@ type DataRecoverHelper interface {
 	Write(message string) bool
 }
 
+// DataRecoverAcker is implemented by the DataRecoverHelpers which keep the
+// messages until they are delivered. The agent then only removes recovered
+// data after the broker confirms it, other helpers are replayed with Read.
+type DataRecoverAcker interface {
+	// Peek returns up to count of the oldest records without removing them.
+	Peek(count int) ([]RecoverRecord, error)
+	// Ack removes records returned by Peek once they are delivered.
+	Ack(ids ...int64) error
+}
+
+// RecoverRecord is a buffered message returned by Peek.
+type RecoverRecord struct {
+	ID      int64
+	Message string
+}
+
+// DataRecoverLimits bounds the size of a DataRecoverHelper, zero values
+// are unlimited. MaxBytes counts the bytes of the stored messages.
+type DataRecoverLimits struct {
+	MaxBytes   int64
+	MaxRows    int
+	MaxAge     time.Duration
+	DropPolicy byte // DropPolicy["DropOldest"] or DropPolicy["DropNewest"]
+	OnDiscard  func(DataRecoverDiscard)
+}
+
+// DataRecoverDiscard reports messages discarded to respect the limits.
+type DataRecoverDiscard struct {
+	Reason     string // "MaxBytes", "MaxRows" or "MaxAge"
+	Count      int
+	Bytes      int64
+	TotalCount int64 // since the helper was created
+	TotalBytes int64
+}
+
+func (limits *DataRecoverLimits) isLimited() bool {
+	return limits.MaxBytes > 0 || limits.MaxRows > 0 || limits.MaxAge > 0
+}
+
+// readAcked implements Read for a DataRecoverAcker, the records are
+// acknowledged as soon as they are returned.
+func readAcked(helper DataRecoverAcker, count int) []string {
+	var messages []string
+	records, err := helper.Peek(count)
+	if err != nil || len(records) == 0 {
+		return messages
+	}
+	var ids []int64
+	for _, record := range records {
+		messages = append(messages, record.Message)
+		ids = append(ids, record.ID)
+	}
+	if err := helper.Ack(ids...); err != nil {
+		return []string{}
+	}
+	return messages
+}
+
+// discardCounter sums the discarded messages and calls OnDiscard.
+type discardCounter struct {
+	totalCount int64
+	totalBytes int64
+}
+
+func (c *discardCounter) report(limits *DataRecoverLimits, logger Logger, reason string, count int, bytes int64) {
+	if count == 0 {
+		return
+	}
+	c.totalCount += int64(count)
+	c.totalBytes += bytes
+	logger.Warn("recover data discarded", "reason", reason, "count", count, "bytes", bytes)
+	if limits.OnDiscard != nil {
+		limits.OnDiscard(DataRecoverDiscard{
+			Reason:     reason,
+			Count:      count,
+			Bytes:      bytes,
+			TotalCount: c.totalCount,
+			TotalBytes: c.totalBytes,
+		})
+	}
+}
+
 type dataRecoverHelper struct {
 	lock     sync.Mutex
 	filePath string
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	created  bool
+	counted  bool
+	rows     int // totals of the Data table, counted once at open
+	bytes    int64
+	limits   DataRecoverLimits
+	discard  discardCounter
+	logger   Logger
 }
 
-// NewDataRecoverHelper ...
+// NewDataRecoverHelper returns the SQLite DataRecoverHelper, it needs cgo.
 func NewDataRecoverHelper(path string) DataRecoverHelper {
+	return newDataRecoverHelper(path, DataRecoverLimits{}, defaultLogger())
+}
+
+// NewDataRecoverHelperWithLimits ...
+func NewDataRecoverHelperWithLimits(path string, limits DataRecoverLimits) DataRecoverHelper {
+	return newDataRecoverHelper(path, limits, defaultLogger())
+}
+
+func newDataRecoverHelper(path string, limits DataRecoverLimits, logger Logger) *dataRecoverHelper {
 	return &dataRecoverHelper{
 		filePath: path,
+		fileMode: defaultFileMode,
+		dirMode:  defaultDirMode,
+		limits:   limits,
+		logger:   withFields(logger, "path", path),
 	}
 }
 
-func (helper *dataRecoverHelper) IsDataExist() bool {
-	if _, err := os.Stat(helper.filePath); os.IsNotExist(err) {
-		return false
+// open opens the database and creates the Data table when needed, the
+// first call counts the stored rows and bytes. The caller must hold the lock.
+func (helper *dataRecoverHelper) open() (*sql.DB, error) {
+	if !helper.created {
+		if err := os.MkdirAll(filepath.Dir(helper.filePath), helper.dirMode); err != nil {
+			return nil, err
+		}
 	}
-	helper.lock.Lock()
 	db, err := sql.Open("sqlite3", helper.filePath)
-
-	defer func() {
-		helper.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS Data (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, message TEXT NOT NULL, ts INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
 		db.Close()
-	}()
+		return nil, err
+	}
+	// files written by earlier versions have no ts column, their rows never expire
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('Data') WHERE name = 'ts'").Scan(&count)
+	if err == nil && count == 0 {
+		_, err = db.Exec("ALTER TABLE Data ADD COLUMN ts INTEGER NOT NULL DEFAULT 0")
+	}
+	if err == nil {
+		_, err = db.Exec("CREATE INDEX IF NOT EXISTS Data_ts ON Data(ts)")
+	}
+	if err == nil && !helper.counted {
+		err = db.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(CAST(message AS BLOB))), 0) FROM Data").Scan(&helper.rows, &helper.bytes)
+		helper.counted = err == nil
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !helper.created {
+		if err := os.Chmod(helper.filePath, helper.fileMode); err != nil {
+			db.Close()
+			return nil, err
+		}
+		helper.created = true
+	}
+	return db, nil
+}
 
+// deleteOldest deletes the oldest rows until count rows or bytes are
+// removed and returns what was deleted.
+func deleteOldest(tx *sql.Tx, rows int, bytes int64) (int, int64, error) {
+	var ids []interface{}
+	var deletedBytes int64
+	query, err := tx.Query("SELECT id, LENGTH(CAST(message AS BLOB)) FROM Data ORDER BY id")
 	if err != nil {
-		fmt.Println(err)
+		return 0, 0, err
+	}
+	for query.Next() && (len(ids) < rows || deletedBytes < bytes) {
+		var id, length int64
+		if err := query.Scan(&id, &length); err != nil {
+			query.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+		deletedBytes += length
+	}
+	query.Close()
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	if _, err := tx.Exec("DELETE FROM Data WHERE id IN ("+placeholders+")", ids...); err != nil {
+		return 0, 0, err
+	}
+	return len(ids), deletedBytes, nil
+}
+
+// expire deletes the rows older than MaxAge, the caller must hold the lock.
+func (helper *dataRecoverHelper) expire(db *sql.DB) error {
+	if helper.limits.MaxAge <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(-helper.limits.MaxAge).UnixNano()
+	var count int
+	var bytes int64
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(CAST(message AS BLOB))), 0) FROM Data WHERE ts > 0 AND ts < ?", deadline).Scan(&count, &bytes)
+	if err != nil || count == 0 {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM Data WHERE ts > 0 AND ts < ?", deadline); err != nil {
+		return err
+	}
+	helper.rows -= count
+	helper.bytes -= bytes
+	helper.discard.report(&helper.limits, helper.logger, "MaxAge", count, bytes)
+	return nil
+}
+
+func (helper *dataRecoverHelper) IsDataExist() bool {
+	if _, err := os.Stat(helper.filePath); os.IsNotExist(err) {
 		return false
 	}
-	rows, err := db.Query("SELECT * FROM Data LIMIT 1")
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+
+	db, err := helper.open()
 	if err != nil {
-		fmt.Println(err)
+		helper.logger.Error("open recover database failed", "error", err)
 		return false
 	}
-	result := false
-	if rows != nil {
-		for rows.Next() {
-			result = true
-		}
+	defer db.Close()
+
+	var id int64
+	err = db.QueryRow("SELECT id FROM Data LIMIT 1").Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		helper.logger.Error("query recover data failed", "error", err)
 	}
-	return result
+	return err == nil
 }
 
+// Read removes and returns up to count of the oldest messages. A message
+// lost between Read and its delivery cannot be recovered, use Peek and Ack.
 func (helper *dataRecoverHelper) Read(count int) []string {
-	var messages []string
-	var emptyMessages []string
-	var ids []int
+	return readAcked(helper, count)
+}
+
+func (helper *dataRecoverHelper) Peek(count int) ([]RecoverRecord, error) {
 	if _, err := os.Stat(helper.filePath); os.IsNotExist(err) {
-		return emptyMessages
+		return nil, nil
 	}
-
 	helper.lock.Lock()
-	db, err := sql.Open("sqlite3", helper.filePath)
-	defer func() {
-		helper.lock.Unlock()
-		db.Close()
-	}()
+	defer helper.lock.Unlock()
 
+	db, err := helper.open()
 	if err != nil {
-		fmt.Println(err)
-		return emptyMessages
-	}
-	rows, err := db.Query(fmt.Sprintf("SELECT * FROM Data LIMIT %d", count))
-	if err != nil {
-		fmt.Println(err)
-		return emptyMessages
+		helper.logger.Error("open recover database failed", "error", err)
+		return nil, err
 	}
+	defer db.Close()
 
-	if rows == nil {
-		return emptyMessages
+	if err := helper.expire(db); err != nil {
+		helper.logger.Error("expire recover data failed", "error", err)
 	}
+	rows, err := db.Query("SELECT id, message FROM Data ORDER BY id LIMIT ?", count)
+	if err != nil {
+		helper.logger.Error("query recover data failed", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
 
+	var records []RecoverRecord
 	for rows.Next() {
-		var id int
-		var message string
-		err = rows.Scan(&id, &message)
-		if err != nil {
-			fmt.Println(err)
+		var record RecoverRecord
+		if err := rows.Scan(&record.ID, &record.Message); err != nil {
+			helper.logger.Error("scan recover data failed", "error", err)
+			return nil, err
 		}
-		messages = append(messages, message)
-		ids = append(ids, id)
+		records = append(records, record)
 	}
-	var str string
-	for _, value := range ids {
-		str += strconv.Itoa(value) + ","
+	if err := rows.Err(); err != nil {
+		helper.logger.Error("query recover data failed", "error", err)
+		return nil, err
 	}
+	return records, nil
+}
 
-	sql, err := db.Prepare("DELETE FROM Data WHERE id IN (" + str[:len(str)-1] + ")")
-	if err != nil {
-		fmt.Println(err)
-		return emptyMessages
+func (helper *dataRecoverHelper) Ack(ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
 	}
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
 
-	_, err = sql.Exec()
+	db, err := helper.open()
 	if err != nil {
-		fmt.Println(err)
-		return emptyMessages
+		helper.logger.Error("open recover database failed", "error", err)
+		return err
 	}
+	defer db.Close()
 
-	return messages
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	tx, err := db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		var rows int
+		var bytes int64
+		err = tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(CAST(message AS BLOB))), 0) FROM Data WHERE id IN ("+placeholders+")", args...).Scan(&rows, &bytes)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM Data WHERE id IN ("+placeholders+")", args...)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err == nil {
+			helper.rows -= rows
+			helper.bytes -= bytes
+		}
+	}
+	if err != nil {
+		helper.logger.Error("delete recover data failed", "error", err)
+		return err
+	}
+	return nil
 }
 
 func (helper *dataRecoverHelper) Write(message string) bool {
 	helper.lock.Lock()
-	db, err := sql.Open("sqlite3", helper.filePath)
-
-	defer func() {
-		helper.lock.Unlock()
-		db.Close()
-	}()
+	defer helper.lock.Unlock()
 
+	db, err := helper.open()
 	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-	sql, err := db.Prepare("CREATE TABLE IF NOT EXISTS Data (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, message TEXT NOT NULL)")
-	if err != nil {
-		fmt.Println(err)
+		helper.logger.Error("open recover database failed", "error", err)
 		return false
 	}
-	_, err = sql.Exec()
-	if err != nil {
-		fmt.Println(err)
-		return false
+	defer db.Close()
+
+	if !helper.limits.isLimited() {
+		_, err = db.Exec("INSERT INTO Data(message, ts) VALUES(?, ?)", message, time.Now().UnixNano())
+		if err != nil {
+			helper.logger.Error("insert recover data failed", "error", err)
+			return false
+		}
+		helper.rows++
+		helper.bytes += int64(len(message))
+		return true
 	}
-	sql, err = db.Prepare("INSERT INTO Data(message) VALUES(?)")
-	if err != nil {
-		fmt.Println(err)
-		return false
+
+	if err := helper.expire(db); err != nil {
+		helper.logger.Error("expire recover data failed", "error", err)
 	}
-	_, err = sql.Exec(message)
+	ok, err := helper.writeLimited(db, message)
 	if err != nil {
-		fmt.Println(err)
+		helper.logger.Error("insert recover data failed", "error", err)
 		return false
 	}
-	return true
+	return ok
 }
 
-func checkErr(err error) {
+// writeLimited inserts message applying MaxRows, MaxBytes and DropPolicy.
+func (helper *dataRecoverHelper) writeLimited(db *sql.DB, message string) (bool, error) {
+	limits := &helper.limits
+	size := int64(len(message))
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		helper.discard.report(limits, helper.logger, "MaxBytes", 1, size)
+		return false, nil
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		fmt.Println(err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	rows, bytes := helper.rows, helper.bytes
+	overRows := 0
+	if limits.MaxRows > 0 && rows+1 > limits.MaxRows {
+		overRows = rows + 1 - limits.MaxRows
+	}
+	var overBytes int64
+	if limits.MaxBytes > 0 && bytes+size > limits.MaxBytes {
+		overBytes = bytes + size - limits.MaxBytes
+	}
+
+	reason := "MaxRows"
+	if overRows == 0 {
+		reason = "MaxBytes"
+	}
+	if (overRows > 0 || overBytes > 0) && limits.DropPolicy == DropPolicy["DropNewest"] {
+		helper.discard.report(limits, helper.logger, reason, 1, size)
+		return false, nil
+	}
+	var deletedRows int
+	var deletedBytes int64
+	if overRows > 0 || overBytes > 0 {
+		deletedRows, deletedBytes, err = deleteOldest(tx, overRows, overBytes)
+		if err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO Data(message, ts) VALUES(?, ?)", message, time.Now().UnixNano()); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
 	}
+	helper.rows += 1 - deletedRows
+	helper.bytes += size - deletedBytes
+	helper.discard.report(limits, helper.logger, reason, deletedRows, deletedBytes)
+	return true, nil
 }
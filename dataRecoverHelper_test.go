@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestDatabase(t *testing.T, path string, limits DataRecoverLimits) *dataRecoverHelper {
+	t.Helper()
+	if !cgoEnabled {
+		t.Skip("SQLite needs cgo")
+	}
+	return newDataRecoverHelper(path, limits, NewNopLogger())
+}
+
+func expectTotals(t *testing.T, helper *dataRecoverHelper, rows int, bytes int64) {
+	t.Helper()
+	if helper.rows != rows || helper.bytes != bytes {
+		t.Fatalf("totals = %d rows %d bytes, want %d rows %d bytes", helper.rows, helper.bytes, rows, bytes)
+	}
+}
+
+func TestDataRecoverHelperLimits(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recover.sqlite")
+
+	discarded := map[string]int{}
+	limits := DataRecoverLimits{
+		MaxRows:   3,
+		MaxBytes:  10,
+		OnDiscard: func(discard DataRecoverDiscard) { discarded[discard.Reason] += discard.Count },
+	}
+	helper := newTestDatabase(t, path, limits)
+	for _, message := range []string{"m1", "m2", "m3", "m4"} {
+		if !helper.Write(message) {
+			t.Fatalf("Write(%q) failed", message)
+		}
+	}
+	expectTotals(t, helper, 3, 6)
+	if !helper.Write("message") {
+		t.Fatal("Write(message) failed")
+	}
+	expectTotals(t, helper, 2, 9)
+	if helper.Write(strings.Repeat("x", 11)) {
+		t.Fatal("Write of a message over MaxBytes succeeded")
+	}
+	if discarded["MaxRows"] != 3 || discarded["MaxBytes"] != 1 {
+		t.Fatalf("discarded = %v", discarded)
+	}
+
+	// a new helper counts the rows already stored
+	helper = newTestDatabase(t, path, limits)
+	if !helper.IsDataExist() {
+		t.Fatal("IsDataExist = false")
+	}
+	expectTotals(t, helper, 2, 9)
+	if got := helper.Read(1); strings.Join(got, ",") != "m4" {
+		t.Fatalf("Read = %q", got)
+	}
+	expectTotals(t, helper, 1, 7)
+	if got := helper.Read(10); strings.Join(got, ",") != "message" {
+		t.Fatalf("Read = %q", got)
+	}
+	expectTotals(t, helper, 0, 0)
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_index_list('Data') WHERE name = 'Data_ts'").Scan(&count); err != nil || count != 1 {
+		t.Fatalf("ts index count = %d, %v", count, err)
+	}
+}
+
+func TestDataRecoverHelperDropNewest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	helper := newTestDatabase(t, filepath.Join(dir, "recover.sqlite"), DataRecoverLimits{
+		MaxRows:    2,
+		DropPolicy: DropPolicy["DropNewest"],
+	})
+	helper.Write("m1")
+	helper.Write("m2")
+	if helper.Write("m3") {
+		t.Fatal("Write over MaxRows succeeded with DropNewest")
+	}
+	expectTotals(t, helper, 2, 4)
+	if got := helper.Read(10); strings.Join(got, ",") != "m1,m2" {
+		t.Fatalf("Read = %q", got)
+	}
+}
+
+func TestDataRecoverTypeWithoutCgo(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	options := NewEdgeAgentOptions()
+	options.NodeID = "node1"
+	options.StateDir = dir
+	options.Transport = NewMemoryTransport()
+	options.Logger = NewNopLogger()
+	options.DataRecover = true
+	helper := NewAgent(options).(*agent).dataRecoverHelper
+	_, sqlite := helper.(*dataRecoverHelper)
+	_, file := helper.(*fileDataRecoverHelper)
+	if cgoEnabled && !sqlite || !cgoEnabled && !file {
+		t.Fatalf("cgo %v: default helper is %T", cgoEnabled, helper)
+	}
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// validateData checks every tag value against the config cache, see
+// DataValidation. It returns the data to send, the invalid values and false
+// when nothing is left to send.
+func (a *agent) validateData(data EdgeData) (EdgeData, TagValueErrors, bool) {
+	// the cache is merged in place, keep it locked while checking
+	a.cfgLock.RLock()
+	defer a.cfgLock.RUnlock()
+	var devices map[string]interface{}
+	if node, ok := a.cfgCache.D.Scada[a.options.NodeID].(map[string]interface{}); ok {
+		devices = childMap(node, "Device")
+	}
+
+	drop := a.options.DataValidation == DataValidation["Drop"]
+	var invalid TagValueErrors
+	list := make([]EdgeTag, 0, len(data.TagList))
+	for _, tag := range data.TagList {
+		if err := checkTagValue(devices, tag); err != nil {
+			invalid = append(invalid, &TagValueError{DeviceID: tag.DeviceID, TagName: tag.TagName, Err: err})
+			a.logger.Warn("invalid tag value", "deviceID", tag.DeviceID, "tagName", tag.TagName, "value", tag.Value, "error", err)
+			if drop {
+				continue
+			}
+		}
+		list = append(list, tag)
+	}
+	data.TagList = list
+	return data, invalid, len(list) > 0 || len(invalid) == 0
+}
+
+// checkTagValue checks the value against the type and array size of the
+// cached tag.
+func checkTagValue(devices map[string]interface{}, tag EdgeTag) error {
+	device, ok := devices[tag.DeviceID].(map[string]interface{})
+	if !ok {
+		return errors.New("unknown device")
+	}
+	config, ok := childMap(device, "Tag")[tag.TagName].(map[string]interface{})
+	if !ok {
+		return errors.New("unknown tag")
+	}
+	tagType, _ := cfgNumber(config["Type"])
+	arraySize, _ := cfgNumber(config["Ary"])
+
+	if arraySize <= 0 {
+		return checkScalarValue(byte(tagType), tag.Value)
+	}
+
+	v := reflect.ValueOf(tag.Value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		if v.Len() > int(arraySize) {
+			return fmt.Errorf("array of %d values exceeds array size %d", v.Len(), int(arraySize))
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := checkScalarValue(byte(tagType), v.Index(i).Interface()); err != nil {
+				return fmt.Errorf("index %d: %v", i, err)
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			index, err := strconv.Atoi(fmt.Sprint(iter.Key().Interface()))
+			if err != nil || index < 0 || index >= int(arraySize) {
+				return fmt.Errorf("index %v out of array size %d", iter.Key().Interface(), int(arraySize))
+			}
+			if err := checkScalarValue(byte(tagType), iter.Value().Interface()); err != nil {
+				return fmt.Errorf("index %d: %v", index, err)
+			}
+		}
+	default:
+		return fmt.Errorf("array tag of size %d needs a slice or index map", int(arraySize))
+	}
+	return nil
+}
+
+func checkScalarValue(tagType byte, value interface{}) error {
+	switch tagType {
+	case TagType["Analog"]:
+		if _, ok := numberValue(value); !ok {
+			return fmt.Errorf("analog tag needs a number, got %T", value)
+		}
+	case TagType["Discrete"]:
+		n, ok := numberValue(value)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("discrete tag needs an integer state, got %T", value)
+		}
+		if n < 0 || n > 7 {
+			return fmt.Errorf("discrete state %v out of 0-7", n)
+		}
+	case TagType["Text"]:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("text tag needs a string, got %T", value)
+		}
+	}
+	return nil
+}
+
+// numberValue returns any integer or float value as float64.
+func numberValue(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
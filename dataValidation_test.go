@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckTagValue(t *testing.T) {
+	devices := map[string]interface{}{
+		"Device1": map[string]interface{}{
+			"Tag": map[string]interface{}{
+				"ATag":   map[string]interface{}{"Type": float64(TagType["Analog"])},
+				"DTag":   map[string]interface{}{"Type": float64(TagType["Discrete"])},
+				"TTag":   map[string]interface{}{"Type": float64(TagType["Text"])},
+				"AArray": map[string]interface{}{"Type": float64(TagType["Analog"]), "Ary": float64(3)},
+				"DArray": map[string]interface{}{"Type": float64(TagType["Discrete"]), "Ary": float64(2)},
+			},
+		},
+	}
+	tests := []struct {
+		device string
+		tag    string
+		value  interface{}
+		err    string
+	}{
+		{"Device1", "ATag", 1.5, ""},
+		{"Device1", "ATag", uint8(3), ""},
+		{"Device1", "ATag", "1.5", "analog tag needs a number, got string"},
+		{"Device1", "DTag", 0, ""},
+		{"Device1", "DTag", 7, ""},
+		{"Device1", "DTag", 8, "discrete state 8 out of 0-7"},
+		{"Device1", "DTag", -1, "discrete state -1 out of 0-7"},
+		{"Device1", "DTag", 1.5, "discrete tag needs an integer state, got float64"},
+		{"Device1", "TTag", "on", ""},
+		{"Device1", "TTag", 1, "text tag needs a string, got int"},
+		{"Device1", "AArray", AnalogArray{1, 2, 3}, ""},
+		{"Device1", "AArray", AnalogArray{1, 2, 3, 4}, "array of 4 values exceeds array size 3"},
+		{"Device1", "AArray", []interface{}{1, "x"}, "index 1: analog tag needs a number, got string"},
+		{"Device1", "AArray", ArrayUpdate{2: 1.5}, ""},
+		{"Device1", "AArray", ArrayUpdate{3: 1.5}, "index 3 out of array size 3"},
+		{"Device1", "AArray", 1.5, "array tag of size 3 needs a slice or index map"},
+		{"Device1", "DArray", DiscreteArray{0, 9}, "index 1: discrete state 9 out of 0-7"},
+		{"Device1", "Unknown", 1, "unknown tag"},
+		{"Device2", "ATag", 1, "unknown device"},
+	}
+	for _, test := range tests {
+		err := checkTagValue(devices, EdgeTag{DeviceID: test.device, TagName: test.tag, Value: test.value})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("%s/%s %#v: error %q, want %q", test.device, test.tag, test.value, got, test.err)
+		}
+	}
+}
+
+func TestSendDataInvalid(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	options := NewEdgeAgentOptions()
+	options.NodeID = "node1"
+	options.StateDir = dir
+	options.Transport = NewMemoryTransport()
+	options.Logger = NewNopLogger()
+	options.DataValidation = DataValidation["Drop"]
+	a := NewAgent(options).(*agent)
+
+	config := EdgeConfig{Node: NewNodeConfig()}
+	device := NewDeviceConfig("Device1")
+	device.AnalogTagList = append(device.AnalogTagList, NewAnaglogTagConfig("ATag"))
+	config.Node.DeviceList = append(config.Node.DeviceList, device)
+	message, err := a.convertConfig(Action["Create"], config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.applyConfig(message)
+
+	data := EdgeData{TagList: []EdgeTag{
+		{DeviceID: "Device1", TagName: "ATag", Value: "high"},
+		{DeviceID: "Device1", TagName: "Other", Value: 1},
+	}}
+	result, err := a.SendDataContext(context.Background(), data)
+	var errs TagValueErrors
+	if !errors.Is(err, ErrInvalidData) || !errors.As(err, &errs) {
+		t.Fatalf("SendData = %v, want TagValueErrors", err)
+	}
+	if result.Invalid != 2 || len(errs) != 2 || errs[1].TagName != "Other" || !strings.Contains(errs[1].Error(), "unknown tag") {
+		t.Fatalf("result %+v, errors %v", result, errs)
+	}
+	if len(options.Transport.(*MemoryTransport).Published()) != 0 {
+		t.Fatal("invalid data was published")
+	}
+}
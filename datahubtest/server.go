@@ -0,0 +1,407 @@
+// Package datahubtest provides a fake WISE-PaaS/DataHub cloud for testing
+// agents without a broker or network access.
+//
+// A Server plays the DataHub side of the /wisepaas/scada/... topic contract
+// over agent.MemoryTransport and serves the DCCS credential endpoint on a
+// loopback HTTP server:
+//
+//	server := datahubtest.NewServer()
+//	defer server.Close()
+//	options := server.AgentOptions("nodeID")
+//	edgeAgent := agent.NewAgent(options)
+//	edgeAgent.Connect()
+package datahubtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	agent "github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK"
+)
+
+const topicPrefix = "/wisepaas/scada/"
+
+// Credential is returned by the DCCS endpoint.
+type Credential struct {
+	Host     string
+	Port     int
+	UserName string
+	Password string
+}
+
+// NodeState is the connection state of a node or device as seen by DataHub.
+type NodeState struct {
+	Connected     bool
+	Heartbeats    int
+	LastHeartbeat time.Time
+	Devices       map[string]*NodeState
+	DeviceStatus  map[string]byte
+}
+
+// ConfigMessage is a cfg message received from an agent.
+type ConfigMessage struct {
+	Action  byte
+	Scada   map[string]interface{}
+	Payload string
+}
+
+// DataMessage is a data message received from an agent.
+type DataMessage struct {
+	Timestamp time.Time
+	Values    map[string]map[string]interface{}
+	Payload   string
+}
+
+// Server is a fake DataHub cloud.
+type Server struct {
+	lock       sync.Mutex
+	http       *httptest.Server
+	stateDir   string
+	key        string
+	credential Credential
+	ackResult  bool
+	transports []*agent.MemoryTransport
+	nodes      map[string]*NodeState
+	configs    map[string][]ConfigMessage
+	data       map[string][]DataMessage
+}
+
+// NewServer starts a fake DataHub cloud. Close must be called to stop the
+// DCCS HTTP server.
+func NewServer() *Server {
+	s := &Server{
+		key: "datahubtest",
+		credential: Credential{
+			Host:     "127.0.0.1",
+			Port:     1883,
+			UserName: "datahubtest",
+			Password: "datahubtest",
+		},
+		ackResult: true,
+		nodes:     make(map[string]*NodeState),
+		configs:   make(map[string][]ConfigMessage),
+		data:      make(map[string][]DataMessage),
+	}
+	stateDir, err := ioutil.TempDir("", "datahubtest")
+	if err != nil {
+		panic(fmt.Sprintf("datahubtest: failed to create the state dir: %v", err))
+	}
+	s.stateDir = stateDir
+	s.http = httptest.NewServer(http.HandlerFunc(s.handleDCCS))
+	return s
+}
+
+// Close stops the DCCS HTTP server and removes StateDir.
+func (s *Server) Close() {
+	s.http.Close()
+	os.RemoveAll(s.stateDir)
+}
+
+// StateDir returns the temporary directory used as EdgeAgentOptions.StateDir
+// by AgentOptions, it is removed by Close.
+func (s *Server) StateDir() string {
+	return s.stateDir
+}
+
+// DCCSURL returns the base URL of the DCCS endpoint.
+func (s *Server) DCCSURL() string {
+	return s.http.URL
+}
+
+// DCCSKey returns the only credential key accepted by the DCCS endpoint.
+func (s *Server) DCCSKey() string {
+	return s.key
+}
+
+// SetCredential changes the credential returned by the DCCS endpoint.
+func (s *Server) SetCredential(credential Credential) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.credential = credential
+}
+
+// SetConfigAckResult sets the Cfg value replied to cfg messages,
+// true replies Cfg=1 and false replies Cfg=0.
+func (s *Server) SetConfigAckResult(result bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ackResult = result
+}
+
+// NewTransport returns a transport connected to this server.
+func (s *Server) NewTransport() *agent.MemoryTransport {
+	transport := agent.NewMemoryTransport()
+	transport.OnPublish(func(msg agent.PublishedMessage) {
+		s.handlePublish(transport, msg)
+	})
+	s.lock.Lock()
+	s.transports = append(s.transports, transport)
+	s.lock.Unlock()
+	return transport
+}
+
+// AgentOptions returns DCCS options for nodeID using a new transport
+// connected to this server, the config cache is kept under StateDir.
+func (s *Server) AgentOptions(nodeID string) *agent.EdgeAgentOptions {
+	options := agent.NewEdgeAgentOptions()
+	options.NodeID = nodeID
+	options.StateDir = s.stateDir
+	options.DataRecover = false
+	options.DCCS.URL = s.DCCSURL()
+	options.DCCS.Key = s.DCCSKey()
+	options.Transport = s.NewTransport()
+	return options
+}
+
+// Node returns a copy of the state of nodeID, nil if the node never connected.
+func (s *Server) Node(nodeID string) *NodeState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	node, ok := s.nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	state := *node
+	state.Devices = make(map[string]*NodeState)
+	for id, device := range node.Devices {
+		d := *device
+		state.Devices[id] = &d
+	}
+	state.DeviceStatus = make(map[string]byte)
+	for id, status := range node.DeviceStatus {
+		state.DeviceStatus[id] = status
+	}
+	return &state
+}
+
+// Configs returns the cfg messages received for nodeID in order.
+func (s *Server) Configs(nodeID string) []ConfigMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]ConfigMessage(nil), s.configs[nodeID]...)
+}
+
+// Data returns the data messages received for nodeID in order.
+func (s *Server) Data(nodeID string) []DataMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]DataMessage(nil), s.data[nodeID]...)
+}
+
+// LastValue returns the most recent value received for a tag.
+func (s *Server) LastValue(nodeID string, deviceID string, tagName string) (interface{}, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	messages := s.data[nodeID]
+	for i := len(messages) - 1; i >= 0; i-- {
+		if value, ok := messages[i].Values[deviceID][tagName]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// WriteValue sends a "WV" command. An empty deviceID uses the node cmd topic.
+// It returns the number of agents which received the command.
+func (s *Server) WriteValue(nodeID string, deviceID string, values map[string]map[string]interface{}) int {
+	d := map[string]interface{}{
+		"Cmd": "WV",
+		"Val": values,
+	}
+	return s.sendCmd(nodeID, deviceID, d)
+}
+
+// TimeSync sends a "TSyn" command. An empty deviceID uses the node cmd topic.
+// It returns the number of agents which received the command.
+func (s *Server) TimeSync(nodeID string, deviceID string, utc time.Time) int {
+	d := map[string]interface{}{
+		"Cmd": "TSyn",
+		"UTC": utc.Unix(),
+	}
+	return s.sendCmd(nodeID, deviceID, d)
+}
+
+func (s *Server) sendCmd(nodeID string, deviceID string, d map[string]interface{}) int {
+	topic := fmt.Sprintf("%s%s/cmd", topicPrefix, nodeID)
+	if deviceID != "" {
+		topic = fmt.Sprintf("%s%s/%s/cmd", topicPrefix, nodeID, deviceID)
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"d":  d,
+		"ts": time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+	})
+	return s.deliver(topic, payload)
+}
+
+func (s *Server) deliver(topic string, payload []byte) int {
+	s.lock.Lock()
+	transports := append([]*agent.MemoryTransport(nil), s.transports...)
+	s.lock.Unlock()
+
+	count := 0
+	for _, transport := range transports {
+		count += transport.Deliver(topic, payload)
+	}
+	return count
+}
+
+func (s *Server) handleDCCS(w http.ResponseWriter, r *http.Request) {
+	const path = "/v1/serviceCredentials/"
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, path) {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.TrimPrefix(r.URL.Path, path) != s.key {
+		http.Error(w, "invalid credential key", http.StatusNotFound)
+		return
+	}
+
+	s.lock.Lock()
+	c := s.credential
+	s.lock.Unlock()
+
+	protocol := func(ssl bool, port int) map[string]interface{} {
+		return map[string]interface{}{
+			"ssl":      ssl,
+			"username": c.UserName,
+			"password": c.Password,
+			"port":     port,
+		}
+	}
+	response := map[string]interface{}{
+		"serviceName": "rabbitmq",
+		"serviceHost": c.Host,
+		"credential": map[string]interface{}{
+			"username": c.UserName,
+			"password": c.Password,
+			"protocols": map[string]interface{}{
+				"mqtt":     protocol(false, c.Port),
+				"mqtt+ssl": protocol(true, c.Port),
+			},
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handlePublish(transport *agent.MemoryTransport, msg agent.PublishedMessage) {
+	if !strings.HasPrefix(msg.Topic, topicPrefix) {
+		return
+	}
+	levels := strings.Split(strings.TrimPrefix(msg.Topic, topicPrefix), "/")
+	nodeID := levels[0]
+	switch {
+	case len(levels) == 2 && levels[1] == "cfg":
+		s.handleConfig(transport, nodeID, msg.Payload)
+	case len(levels) == 2 && levels[1] == "data":
+		s.handleData(nodeID, msg.Payload)
+	case len(levels) == 2 && levels[1] == "conn":
+		s.handleConn(nodeID, "", msg.Payload)
+	case len(levels) == 3 && levels[2] == "conn":
+		s.handleConn(nodeID, levels[1], msg.Payload)
+	}
+}
+
+func (s *Server) handleConfig(transport *agent.MemoryTransport, nodeID string, payload string) {
+	var message struct {
+		D struct {
+			Action byte
+			Scada  map[string]interface{}
+		} `json:"d"`
+	}
+	if err := json.Unmarshal([]byte(payload), &message); err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.configs[nodeID] = append(s.configs[nodeID], ConfigMessage{
+		Action:  message.D.Action,
+		Scada:   message.D.Scada,
+		Payload: payload,
+	})
+	cfg := 0
+	if s.ackResult {
+		cfg = 1
+	}
+	s.lock.Unlock()
+
+	ack, _ := json.Marshal(map[string]interface{}{
+		"d":  map[string]interface{}{"Cfg": cfg},
+		"ts": time.Now().UTC().Format(time.RFC3339),
+	})
+	transport.Deliver(fmt.Sprintf("%s%s/ack", topicPrefix, nodeID), ack)
+}
+
+func (s *Server) handleData(nodeID string, payload string) {
+	var message struct {
+		Ts string                            `json:"ts"`
+		D  map[string]map[string]interface{} `json:"d"`
+	}
+	if err := json.Unmarshal([]byte(payload), &message); err != nil {
+		return
+	}
+	ts, _ := time.Parse(time.RFC3339Nano, message.Ts)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data[nodeID] = append(s.data[nodeID], DataMessage{
+		Timestamp: ts,
+		Values:    message.D,
+		Payload:   payload,
+	})
+}
+
+func (s *Server) handleConn(nodeID string, deviceID string, payload string) {
+	var message struct {
+		D struct {
+			Con *byte
+			Hbt *byte
+			DsC *byte
+			UeD *byte
+			Dev map[string]byte
+		} `json:"d"`
+	}
+	if err := json.Unmarshal([]byte(payload), &message); err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	node, ok := s.nodes[nodeID]
+	if !ok {
+		node = &NodeState{
+			Devices:      make(map[string]*NodeState),
+			DeviceStatus: make(map[string]byte),
+		}
+		s.nodes[nodeID] = node
+	}
+	state := node
+	if deviceID != "" {
+		if state, ok = node.Devices[deviceID]; !ok {
+			state = &NodeState{}
+			node.Devices[deviceID] = state
+		}
+	}
+
+	d := message.D
+	switch {
+	case d.Con != nil:
+		state.Connected = true
+	case d.Hbt != nil:
+		state.Connected = true
+		state.Heartbeats++
+		state.LastHeartbeat = time.Now()
+	case d.DsC != nil, d.UeD != nil:
+		state.Connected = false
+	}
+	for id, status := range d.Dev {
+		node.DeviceStatus[id] = status
+	}
+}
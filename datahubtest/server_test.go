@@ -0,0 +1,107 @@
+package datahubtest_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	agent "github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK"
+	"github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK/datahubtest"
+)
+
+// connect connects edgeAgent and waits for the OnConnect handler, which
+// runs after the subscriptions are made.
+func connect(t *testing.T, edgeAgent agent.Agent) {
+	t.Helper()
+	connected := make(chan struct{}, 1)
+	edgeAgent.SetOnConnectHandler(func(agent.Agent) {
+		connected <- struct{}{}
+	})
+	if err := edgeAgent.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnConnect not called")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	server := datahubtest.NewServer()
+	defer server.Close()
+
+	options := server.AgentOptions("node1")
+	options.Logger = agent.NewNopLogger()
+	edgeAgent := agent.NewAgent(options)
+	received := make(chan agent.MessageReceivedEventArgs, 1)
+	edgeAgent.SetOnMessageReceiveHandler(func(args agent.MessageReceivedEventArgs) {
+		if args.Type != agent.MessageType["ConfigAck"] {
+			received <- args
+		}
+	})
+
+	connect(t, edgeAgent)
+	defer edgeAgent.Disconnect()
+	if node := server.Node("node1"); node == nil || !node.Connected {
+		t.Fatalf("node1 is not connected: %+v", node)
+	}
+
+	config := agent.EdgeConfig{Node: agent.NewNodeConfig()}
+	config.Node.SetType(agent.EdgeType["Gateway"])
+	device := agent.NewDeviceConfig("Device1")
+	device.SetName("Device 1")
+	device.SetType("Smart Device")
+	analog := agent.NewAnaglogTagConfig("ATag1")
+	analog.SetSpanHigh(1000)
+	device.AnalogTagList = append(device.AnalogTagList, analog)
+	config.Node.DeviceList = append(config.Node.DeviceList, device)
+	if err := edgeAgent.UploadConfigE(agent.Action["Create"], config); err != nil {
+		t.Fatalf("UploadConfig: %v", err)
+	}
+	configs := server.Configs("node1")
+	if len(configs) != 1 || configs[0].Action != agent.Action["Create"] {
+		t.Fatalf("configs = %+v, want one Create", configs)
+	}
+
+	data := agent.EdgeData{
+		Timestamp: time.Now(),
+		TagList:   []agent.EdgeTag{{DeviceID: "Device1", TagName: "ATag1", Value: 42.5}},
+	}
+	if result, err := edgeAgent.SendDataE(data); err != nil || result.Published != 1 {
+		t.Fatalf("SendData = %+v, %v", result, err)
+	}
+	if value, ok := server.LastValue("node1", "Device1", "ATag1"); !ok || value != 42.5 {
+		t.Fatalf("LastValue = %v, %v, want 42.5", value, ok)
+	}
+
+	values := map[string]map[string]interface{}{"Device1": {"ATag1": 7}}
+	if n := server.WriteValue("node1", "", values); n != 1 {
+		t.Fatalf("WriteValue reached %d agents, want 1", n)
+	}
+	select {
+	case args := <-received:
+		message, ok := args.Message.(agent.WriteDataMessage)
+		if args.Type != agent.MessageType["WriteValue"] || !ok {
+			t.Fatalf("received %+v, want a WriteValue", args)
+		}
+		if len(message.DeviceList) != 1 || message.DeviceList[0].ID != "Device1" ||
+			len(message.DeviceList[0].TagList) != 1 || message.DeviceList[0].TagList[0].Name != "ATag1" {
+			t.Fatalf("WriteValue message = %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteValue command not received")
+	}
+}
+
+func TestAgentOptionsStateDir(t *testing.T) {
+	server := datahubtest.NewServer()
+	options := server.AgentOptions("node1")
+	if options.StateDir == "" || options.StateDir != server.StateDir() {
+		t.Fatalf("StateDir = %q, want %q", options.StateDir, server.StateDir())
+	}
+	server.Close()
+	if _, err := os.Stat(options.StateDir); !os.IsNotExist(err) {
+		t.Fatalf("StateDir not removed by Close: %v", err)
+	}
+}
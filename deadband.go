@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// DeadbandOptions is the report by exception setting of a device or a tag,
+// see SetDeadband. A value is sent when it leaves any of the bands set.
+type DeadbandOptions struct {
+	Absolute   float64       // analog values within Absolute of the last sent value are skipped
+	Percent    float64       // same in percent of SpanHigh-SpanLow, or of the last value without span
+	ChangeOnly bool          // values equal to the last sent one are skipped
+	MaxSilence time.Duration // a skipped value is still sent when its sample time is this far after the last sent one, 0 disables
+}
+
+type sentValue struct {
+	value interface{}
+	time  time.Time
+}
+
+// SetDeadband sets the report by exception setting of a tag, or of every tag
+// of the device when tagName is empty. A tag setting overrides the device
+// one, a zero DeadbandOptions removes the setting.
+func (a *agent) SetDeadband(deviceID string, tagName string, options DeadbandOptions) {
+	key := fmt.Sprintf(tagKeyFormat, a.options.NodeID, deviceID, tagName)
+	a.deadbandLock.Lock()
+	defer a.deadbandLock.Unlock()
+	if options == (DeadbandOptions{}) {
+		delete(a.deadbands, key)
+		return
+	}
+	if a.deadbands == nil {
+		a.deadbands = make(map[string]DeadbandOptions)
+		a.sentValues = make(map[string]sentValue)
+	}
+	a.deadbands[key] = options
+}
+
+// filterDeadband removes the values within their deadband and remembers
+// the others as last sent, forgetSent takes them back when they are
+// dropped. It returns the data left and the number removed.
+func (a *agent) filterDeadband(data EdgeData) (EdgeData, int) {
+	a.deadbandLock.Lock()
+	defer a.deadbandLock.Unlock()
+	if len(a.deadbands) == 0 {
+		return data, 0
+	}
+
+	a.cfgLock.RLock()
+	defer a.cfgLock.RUnlock()
+	var devices map[string]interface{}
+	if node, ok := a.cfgCache.D.Scada[a.options.NodeID].(map[string]interface{}); ok {
+		devices = childMap(node, "Device")
+	}
+
+	now := time.Now()
+	skipped := 0
+	list := make([]EdgeTag, 0, len(data.TagList))
+	for _, tag := range data.TagList {
+		key := fmt.Sprintf(tagKeyFormat, a.options.NodeID, tag.DeviceID, tag.TagName)
+		options, ok := a.deadbands[key]
+		if !ok {
+			options, ok = a.deadbands[fmt.Sprintf(tagKeyFormat, a.options.NodeID, tag.DeviceID, "")]
+		}
+		if !ok {
+			list = append(list, tag)
+			continue
+		}
+
+		// MaxSilence is measured in sample time, back-filled samples
+		// are not all sent because they are old
+		ts := data.Timestamp
+		if !tag.Timestamp.IsZero() {
+			ts = tag.Timestamp
+		}
+		if ts.IsZero() {
+			ts = now
+		}
+		last, sent := a.sentValues[key]
+		if sent && (options.MaxSilence <= 0 || ts.Sub(last.time) < options.MaxSilence) {
+			config := childMap(childMap(childMap(devices, tag.DeviceID), "Tag"), tag.TagName)
+			if !valueChanged(options, config, last.value, tag.Value) {
+				skipped++
+				continue
+			}
+		}
+		value := tag.Value
+		if array, ok := arrayValues(value); ok {
+			// a sparse update only changes its indexes of the array DataHub
+			// holds, the copy also protects against a reused slice
+			if lastArray, ok := arrayValues(last.value); ok && sent {
+				for index, v := range array {
+					lastArray[index] = v
+				}
+				array = lastArray
+			}
+			value = array
+		}
+		a.sentValues[key] = sentValue{value: value, time: ts}
+		list = append(list, tag)
+	}
+	data.TagList = list
+	return data, skipped
+}
+
+// forgetSent removes the last sent values of tags which were dropped, so
+// the next values are not compared with values DataHub never received.
+func (a *agent) forgetSent(tags []EdgeTag) {
+	a.deadbandLock.Lock()
+	defer a.deadbandLock.Unlock()
+	if len(a.sentValues) == 0 {
+		return
+	}
+	for _, tag := range tags {
+		key := fmt.Sprintf(tagKeyFormat, a.options.NodeID, tag.DeviceID, tag.TagName)
+		last, ok := a.sentValues[key]
+		if !ok {
+			continue
+		}
+		// a later call may have sent another value meanwhile
+		if !valueChanged(DeadbandOptions{ChangeOnly: true}, nil, last.value, tag.Value) {
+			delete(a.sentValues, key)
+		}
+	}
+}
+
+// valueChanged compares the value with the last sent one, element by element
+// for arrays. Only the indexes of value are compared, a sparse update leaves
+// the others as they are. config is the cached tag, empty when it is unknown.
+func valueChanged(options DeadbandOptions, config map[string]interface{}, last interface{}, value interface{}) bool {
+	lastArray, lastIsArray := arrayValues(last)
+	array, isArray := arrayValues(value)
+	if lastIsArray || isArray {
+		if !lastIsArray || !isArray {
+			return true
+		}
+		for index, v := range array {
+			lastValue, ok := lastArray[index]
+			if !ok || valueChanged(options, config, lastValue, v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	lastNumber, lastIsNumber := numberValue(last)
+	number, isNumber := numberValue(value)
+	tagType, typed := cfgNumber(config["Type"])
+	analog := lastIsNumber && isNumber && (!typed || byte(tagType) == TagType["Analog"])
+	if !analog || (options.Absolute <= 0 && options.Percent <= 0) {
+		return !options.ChangeOnly || !reflect.DeepEqual(last, value)
+	}
+
+	delta := math.Abs(number - lastNumber)
+	if options.Absolute > 0 && delta > options.Absolute {
+		return true
+	}
+	if options.Percent > 0 {
+		base := math.Abs(lastNumber)
+		high, hasHigh := cfgNumber(config["SH"])
+		low, hasLow := cfgNumber(config["SL"])
+		if hasHigh && hasLow && high > low {
+			base = high - low
+		}
+		if delta > base*options.Percent/100 {
+			return true
+		}
+	}
+	return false
+}
+
+// arrayValues returns the elements of a slice or of an index map, such as a
+// sparse ArrayUpdate, by index. A map with a key which is not an index is
+// not an array.
+func arrayValues(value interface{}) (map[int]interface{}, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		values := make(map[int]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			values[i] = v.Index(i).Interface()
+		}
+		return values, true
+	case reflect.Map:
+		values := make(map[int]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			index, err := strconv.Atoi(fmt.Sprint(iter.Key().Interface()))
+			if err != nil || index < 0 {
+				return nil, false
+			}
+			values[index] = iter.Value().Interface()
+		}
+		return values, true
+	}
+	return nil, false
+}
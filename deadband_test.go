@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func newDeadbandTestAgent(t *testing.T) (*agent, func()) {
+	t.Helper()
+	dir := tempDir(t)
+	options := NewEdgeAgentOptions()
+	options.NodeID = "node1"
+	options.StateDir = dir
+	options.Transport = NewMemoryTransport()
+	options.Logger = NewNopLogger()
+	a := NewAgent(options).(*agent)
+
+	config := EdgeConfig{Node: NewNodeConfig()}
+	device := NewDeviceConfig("Device1")
+	span := NewAnaglogTagConfig("Span")
+	span.SetSpanLow(0)
+	span.SetSpanHigh(200)
+	array := NewAnaglogTagConfig("Array")
+	array.SetArraySize(8)
+	device.AnalogTagList = append(device.AnalogTagList, span, array)
+	config.Node.DeviceList = append(config.Node.DeviceList, device)
+	message, err := a.convertConfig(Action["Create"], config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.applyConfig(message)
+	return a, func() { os.RemoveAll(dir) }
+}
+
+type deadbandStep struct {
+	value interface{}
+	at    time.Duration // sample time after the start
+	sent  bool
+}
+
+func runDeadband(t *testing.T, a *agent, tagName string, steps []deadbandStep) {
+	t.Helper()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, step := range steps {
+		data := EdgeData{
+			Timestamp: start.Add(step.at),
+			TagList:   []EdgeTag{{DeviceID: "Device1", TagName: tagName, Value: step.value}},
+		}
+		wantSkipped := 1
+		if step.sent {
+			wantSkipped = 0
+		}
+		left, skipped := a.filterDeadband(data)
+		if sent := len(left.TagList) == 1; sent != step.sent || skipped != wantSkipped {
+			t.Fatalf("step %d %v: sent %v skipped %d, want sent %v", i, step.value, sent, skipped, step.sent)
+		}
+	}
+}
+
+func TestDeadband(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		options DeadbandOptions
+		steps   []deadbandStep
+	}{
+		{
+			name:    "absolute",
+			tag:     "Plain",
+			options: DeadbandOptions{Absolute: 1},
+			steps:   []deadbandStep{{10, 0, true}, {10.5, 0, false}, {9.2, 0, false}, {11.5, 0, true}, {11, 0, false}},
+		},
+		{
+			name:    "percent of span",
+			tag:     "Span",
+			options: DeadbandOptions{Percent: 1},
+			steps:   []deadbandStep{{100, 0, true}, {101.5, 0, false}, {102.5, 0, true}},
+		},
+		{
+			name:    "percent of last value",
+			tag:     "Plain",
+			options: DeadbandOptions{Percent: 10},
+			steps:   []deadbandStep{{50, 0, true}, {54, 0, false}, {56, 0, true}},
+		},
+		{
+			name:    "change only",
+			tag:     "Plain",
+			options: DeadbandOptions{ChangeOnly: true},
+			steps:   []deadbandStep{{"on", 0, true}, {"on", 0, false}, {"off", 0, true}},
+		},
+		{
+			name:    "max silence in sample time",
+			tag:     "Plain",
+			options: DeadbandOptions{ChangeOnly: true, MaxSilence: time.Minute},
+			steps: []deadbandStep{
+				{1, 0, true},
+				{1, 30 * time.Second, false},
+				{1, 61 * time.Second, true},
+				{1, 90 * time.Second, false},
+			},
+		},
+		{
+			name:    "sparse array",
+			tag:     "Array",
+			options: DeadbandOptions{Absolute: 1},
+			steps: []deadbandStep{
+				{AnalogArray{1, 2, 3}, 0, true},
+				{ArrayUpdate{1: 2.5}, 0, false},
+				{ArrayUpdate{5: 1.0}, 0, true},
+				{ArrayUpdate{5: 1.5}, 0, false},
+				{AnalogArray{1, 2, 3}, 0, false},
+				{ArrayUpdate{2: 5.0}, 0, true},
+				{AnalogArray{1, 2, 3}, 0, true},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, cleanup := newDeadbandTestAgent(t)
+			defer cleanup()
+			a.SetDeadband("Device1", test.tag, test.options)
+			runDeadband(t, a, test.tag, test.steps)
+		})
+	}
+}
+
+func TestDeadbandDeviceSetting(t *testing.T) {
+	a, cleanup := newDeadbandTestAgent(t)
+	defer cleanup()
+
+	a.SetDeadband("Device1", "", DeadbandOptions{Absolute: 10})
+	a.SetDeadband("Device1", "Plain", DeadbandOptions{Absolute: 1})
+	runDeadband(t, a, "Other", []deadbandStep{{1, 0, true}, {5, 0, false}})
+	runDeadband(t, a, "Plain", []deadbandStep{{1, 0, true}, {5, 0, true}})
+
+	a.SetDeadband("Device1", "", DeadbandOptions{})
+	runDeadband(t, a, "Other", []deadbandStep{{5, 0, true}, {5, 0, true}})
+}
+
+func TestForgetSent(t *testing.T) {
+	a, cleanup := newDeadbandTestAgent(t)
+	defer cleanup()
+	a.SetDeadband("Device1", "", DeadbandOptions{ChangeOnly: true})
+
+	runDeadband(t, a, "Plain", []deadbandStep{{1, 0, true}})
+	// a value sent later is kept
+	a.forgetSent([]EdgeTag{{DeviceID: "Device1", TagName: "Plain", Value: 2}})
+	runDeadband(t, a, "Plain", []deadbandStep{{1, 0, false}})
+	// the dropped value is not compared against
+	a.forgetSent([]EdgeTag{{DeviceID: "Device1", TagName: "Plain", Value: 1}})
+	runDeadband(t, a, "Plain", []deadbandStep{{1, 0, true}})
+
+	runDeadband(t, a, "Array", []deadbandStep{{AnalogArray{1, 2}, 0, true}, {ArrayUpdate{3: 1.0}, 0, true}})
+	a.forgetSent([]EdgeTag{{DeviceID: "Device1", TagName: "Array", Value: ArrayUpdate{3: 1.0}}})
+	runDeadband(t, a, "Array", []deadbandStep{{AnalogArray{1, 2}, 0, true}})
+}
@@ -1,22 +1,40 @@
 package agent
 
 import (
-	"fmt"
+	"crypto/tls"
+	"os"
 	"time"
 )
 
 // EdgeAgentOptions ...
 type EdgeAgentOptions struct {
-	ReconnectInterval int // second
-	NodeID            string
-	DeviceID          string
-	Type              byte
-	HeartBeatInterval int
-	DataRecover       bool
-	ConnectType       string
-	UseSecure         bool
-	MQTT              *MQTTOptions
-	DCCS              *DCCSOptions
+	ReconnectInterval   int // second
+	NodeID              string
+	DeviceID            string
+	Type                byte
+	HeartBeatInterval   int
+	ConfigAckTimeout    int // second, UploadConfigAndWait
+	ConfigAckRetry      int
+	DataValidation      byte // checks SendData values against the uploaded config
+	FractionConvert     byte // rounds or truncates analog values to their FractionDisplayFormat
+	Async               *AsyncOptions // nil publishes SendData synchronously
+	MaxTagsPerMessage   int           // SendData splits payloads at this many tags, default 100
+	MaxMessageBytes     int           // and at this many bytes, 0 is unlimited
+	DataRecover         bool
+	DataRecoverType     string            // SQLite needs cgo and falls back to File without it
+	DataRecoverHelper   DataRecoverHelper // overrides DataRecoverType when set
+	DataRecoverLimits   DataRecoverLimits
+	StateDir            string      // recover and config cache files are kept in StateDir/NodeID
+	DataRecoverFilePath string      // overrides the path under StateDir
+	TagsCfgFilePath     string      // overrides the path under StateDir
+	FileMode            os.FileMode // permission of the created files
+	DirMode             os.FileMode // permission of the created directories
+	ConnectType         string
+	UseSecure           bool
+	MQTT                *MQTTOptions
+	DCCS                *DCCSOptions
+	Transport           Transport // nil uses NewPahoTransport()
+	Logger              Logger    // nil prints to stdout
 }
 
 // MQTTOptions ...
@@ -26,6 +44,21 @@ type MQTTOptions struct {
 	UserName     string
 	Password     string
 	ProtocalType string
+	TLS          *TLSOptions // used by Protocol["TLS"], Protocol["SecureWebSocket"] and DCCS
+}
+
+// TLSOptions ...
+type TLSOptions struct {
+	CAFile             string // PEM encoded CA bundle, replaces the system pool
+	CAPEM              []byte
+	CertFile           string // PEM encoded client certificate for mutual TLS
+	KeyFile            string
+	CertPEM            []byte
+	KeyPEM             []byte
+	ServerName         string      // not applied to the DCCS request
+	MinVersion         uint16      // e.g. tls.VersionTLS12
+	InsecureSkipVerify bool        // for lab brokers only
+	Config             *tls.Config // when set, every other field is ignored
 }
 
 // DCCSOptions ...
@@ -53,9 +86,21 @@ type EdgeData struct {
 
 // EdgeTag ...
 type EdgeTag struct {
-	DeviceID string
-	TagName  string
-	Value    interface{}
+	DeviceID  string
+	TagName   string
+	Value     interface{}
+	Timestamp time.Time // sample time, EdgeData.Timestamp when zero
+}
+
+// SendResult reports how the payloads of a SendDataE call were handled.
+type SendResult struct {
+	Published int // accepted by the broker
+	Spooled   int // written to the DataRecoverHelper
+	Dropped   int // payloads, or SendData calls refused by the async queue, neither published nor spooled
+	Rejected  int // tag values left out of the payloads, not encodable or over MaxMessageBytes
+	Invalid   int // tag values failing DataValidation, removed by DataValidation["Drop"], see ErrInvalidData
+	Skipped   int // tag values within their deadband, see SetDeadband
+	Queued    int // tag values queued by EdgeAgentOptions.Async
 }
 
 // EdgeDeviceStatus ...
@@ -164,7 +209,12 @@ type TimeSyncMessage struct {
 //	ReconnectInterval: 1
 //	Type: EdgeType["Gateway"]
 //	HeartBeatInterval: HeartBeatInterval
+//	ConfigAckTimeout: 30
+//	ConfigAckRetry: 2
 //	DataRecover: true,
+//	DataRecoverType: DataRecoverType["SQLite"],
+//	FileMode: 0644,
+//	DirMode: 0755,
 //	ConnectType: ConnectType["DCCS"],
 //	UseSecure: false,
 //	MQTT.Port: 1883
@@ -176,7 +226,16 @@ func NewEdgeAgentOptions() *EdgeAgentOptions {
 		DeviceID:          "",
 		Type:              EdgeType["Gateway"],
 		HeartBeatInterval: HeartBeatInterval,
+		ConfigAckTimeout:  defaultConfigAckTimeout,
+		ConfigAckRetry:    2,
+		DataValidation:    DataValidation["None"],
+		FractionConvert:   FractionConvert["None"],
+		MaxTagsPerMessage: dataMaxTagCount,
 		DataRecover:       true,
+		DataRecoverType:   DataRecoverType["SQLite"],
+		StateDir:          "",
+		FileMode:          defaultFileMode,
+		DirMode:           defaultDirMode,
 		ConnectType:       ConnectType["DCCS"],
 		UseSecure:         false,
 		MQTT: &MQTTOptions{
@@ -227,7 +286,7 @@ func NewTextTagConfig(name string) TextTagConfig {
 	}
 }
 
-func getWriteDataMessageFromCmdMessage(data interface{}, ts_string string) WriteDataMessage {
+func getWriteDataMessageFromCmdMessage(data interface{}, ts_string string, logger Logger) WriteDataMessage {
 	m := data.(map[string]interface{})
 
 	layout := "2006-01-02T15:04:05.000Z"
@@ -235,7 +294,7 @@ func getWriteDataMessageFromCmdMessage(data interface{}, ts_string string) Write
 
 	if err != nil {
 		ts = time.Now()
-		fmt.Println(err)
+		logger.Warn("invalid cmd timestamp", "ts", ts_string, "error", err)
 	}
 
 	message := WriteDataMessage{
@@ -282,6 +341,26 @@ func (config *NodeConfig) SetType(t byte) {
 	config.nodeType = t
 }
 
+// SetPrimaryIP ...
+func (config *NodeConfig) SetPrimaryIP(ip string) {
+	config.primaryIP = ip
+}
+
+// SetBackupIP ...
+func (config *NodeConfig) SetBackupIP(ip string) {
+	config.backupIP = ip
+}
+
+// SetPrimaryPort ...
+func (config *NodeConfig) SetPrimaryPort(port int) {
+	config.primaryPort = port
+}
+
+// SetBackupPort ...
+func (config *NodeConfig) SetBackupPort(port int) {
+	config.backupPort = port
+}
+
 // SetName ...
 func (config *DeviceConfig) SetName(name string) {
 	config.name = name
@@ -302,6 +381,21 @@ func (config *DeviceConfig) SetRetentionPolicyName(name string) {
 	config.retentionPolicyName = name
 }
 
+// SetIP ...
+func (config *DeviceConfig) SetIP(ip string) {
+	config.ip = ip
+}
+
+// SetPort ...
+func (config *DeviceConfig) SetPort(port int) {
+	config.port = port
+}
+
+// SetComPortNumber ...
+func (config *DeviceConfig) SetComPortNumber(num int) {
+	config.comPortNumber = num
+}
+
 // SetDescription ...
 func (config *AnalogTagConfig) SetDescription(desc string) {
 	config.description = desc
@@ -0,0 +1,597 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The getters of the config types return false as second value when the
+// attribute is not set, unset attributes are not sent to DataHub.
+
+func configString(v interface{}) (string, bool) {
+	s, ok := v.(string)
+	return s, ok
+}
+
+func configUint(v interface{}) (uint, bool) {
+	u, ok := v.(uint)
+	return u, ok
+}
+
+func configInt(v interface{}) (int, bool) {
+	i, ok := v.(int)
+	return i, ok
+}
+
+func configFloat(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func configBool(v interface{}) (bool, bool) {
+	b, ok := v.(bool)
+	return b, ok
+}
+
+func stringPtr(v string, ok bool) *string {
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+func uintPtr(v uint, ok bool) *uint {
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+func intPtr(v int, ok bool) *int {
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+func floatPtr(v float64, ok bool) *float64 {
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+func boolPtr(v bool, ok bool) *bool {
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+// Type ...
+func (config NodeConfig) Type() (byte, bool) {
+	t, ok := config.nodeType.(byte)
+	return t, ok
+}
+
+// PrimaryIP ...
+func (config NodeConfig) PrimaryIP() (string, bool) {
+	return configString(config.primaryIP)
+}
+
+// BackupIP ...
+func (config NodeConfig) BackupIP() (string, bool) {
+	return configString(config.backupIP)
+}
+
+// PrimaryPort ...
+func (config NodeConfig) PrimaryPort() (int, bool) {
+	return configInt(config.primaryPort)
+}
+
+// BackupPort ...
+func (config NodeConfig) BackupPort() (int, bool) {
+	return configInt(config.backupPort)
+}
+
+// ID ...
+func (config DeviceConfig) ID() string {
+	id, _ := configString(config.id)
+	return id
+}
+
+// Name ...
+func (config DeviceConfig) Name() (string, bool) {
+	return configString(config.name)
+}
+
+// Type ...
+func (config DeviceConfig) Type() (string, bool) {
+	return configString(config.deviceType)
+}
+
+// Description ...
+func (config DeviceConfig) Description() (string, bool) {
+	return configString(config.description)
+}
+
+// IP ...
+func (config DeviceConfig) IP() (string, bool) {
+	return configString(config.ip)
+}
+
+// Port ...
+func (config DeviceConfig) Port() (int, bool) {
+	return configInt(config.port)
+}
+
+// ComPortNumber ...
+func (config DeviceConfig) ComPortNumber() (int, bool) {
+	return configInt(config.comPortNumber)
+}
+
+// RetentionPolicyName ...
+func (config DeviceConfig) RetentionPolicyName() (string, bool) {
+	return configString(config.retentionPolicyName)
+}
+
+// Name ...
+func (config AnalogTagConfig) Name() string {
+	name, _ := configString(config.name)
+	return name
+}
+
+// Description ...
+func (config AnalogTagConfig) Description() (string, bool) {
+	return configString(config.description)
+}
+
+// ReadOnly ...
+func (config AnalogTagConfig) ReadOnly() (bool, bool) {
+	return configBool(config.readOnly)
+}
+
+// ArraySize ...
+func (config AnalogTagConfig) ArraySize() (uint, bool) {
+	return configUint(config.arraySize)
+}
+
+// SpanHigh ...
+func (config AnalogTagConfig) SpanHigh() (float64, bool) {
+	return configFloat(config.spanHigh)
+}
+
+// SpanLow ...
+func (config AnalogTagConfig) SpanLow() (float64, bool) {
+	return configFloat(config.spanLow)
+}
+
+// EngineerUnit ...
+func (config AnalogTagConfig) EngineerUnit() (string, bool) {
+	return configString(config.engineerUnit)
+}
+
+// IntegerDisplayFormat ...
+func (config AnalogTagConfig) IntegerDisplayFormat() (uint, bool) {
+	return configUint(config.integerDisplayFormat)
+}
+
+// FractionDisplayFormat ...
+func (config AnalogTagConfig) FractionDisplayFormat() (uint, bool) {
+	return configUint(config.fractionDisplayFormat)
+}
+
+// Name ...
+func (config DiscreteTagConfig) Name() string {
+	name, _ := configString(config.name)
+	return name
+}
+
+// Description ...
+func (config DiscreteTagConfig) Description() (string, bool) {
+	return configString(config.description)
+}
+
+// ReadOnly ...
+func (config DiscreteTagConfig) ReadOnly() (bool, bool) {
+	return configBool(config.readOnly)
+}
+
+// ArraySize ...
+func (config DiscreteTagConfig) ArraySize() (uint, bool) {
+	return configUint(config.arraySize)
+}
+
+// State0 ...
+func (config DiscreteTagConfig) State0() (string, bool) {
+	return configString(config.state0)
+}
+
+// State1 ...
+func (config DiscreteTagConfig) State1() (string, bool) {
+	return configString(config.state1)
+}
+
+// State2 ...
+func (config DiscreteTagConfig) State2() (string, bool) {
+	return configString(config.state2)
+}
+
+// State3 ...
+func (config DiscreteTagConfig) State3() (string, bool) {
+	return configString(config.state3)
+}
+
+// State4 ...
+func (config DiscreteTagConfig) State4() (string, bool) {
+	return configString(config.state4)
+}
+
+// State5 ...
+func (config DiscreteTagConfig) State5() (string, bool) {
+	return configString(config.state5)
+}
+
+// State6 ...
+func (config DiscreteTagConfig) State6() (string, bool) {
+	return configString(config.state6)
+}
+
+// State7 ...
+func (config DiscreteTagConfig) State7() (string, bool) {
+	return configString(config.state7)
+}
+
+// Name ...
+func (config TextTagConfig) Name() string {
+	name, _ := configString(config.name)
+	return name
+}
+
+// Description ...
+func (config TextTagConfig) Description() (string, bool) {
+	return configString(config.description)
+}
+
+// ReadOnly ...
+func (config TextTagConfig) ReadOnly() (bool, bool) {
+	return configBool(config.readOnly)
+}
+
+// ArraySize ...
+func (config TextTagConfig) ArraySize() (uint, bool) {
+	return configUint(config.arraySize)
+}
+
+// Validate returns every problem of the config as ConfigErrors, e.g. empty
+// or duplicate tag names and SpanLow above SpanHigh, nil when it is valid.
+func (config EdgeConfig) Validate() error {
+	var errs ConfigErrors
+	devices := config.Node.DeviceList
+	(configFile{Node: config.Node.file()}).validate(func(device int, tag int, err error) {
+		path := "Node"
+		if device >= 0 {
+			path = fmt.Sprintf("Device[%d]", device)
+		}
+		if tag >= 0 {
+			path += "." + tagConfigPath(devices[device], tag)
+		}
+		errs = append(errs, &ConfigError{Path: path, Err: err})
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// tagConfigPath returns the path of the i-th tag of DeviceConfig.file.
+func tagConfigPath(device DeviceConfig, i int) string {
+	kind, name := "AnalogTag", ""
+	switch {
+	case i < len(device.AnalogTagList):
+		name = device.AnalogTagList[i].Name()
+	case i-len(device.AnalogTagList) < len(device.DiscreteTagList):
+		i -= len(device.AnalogTagList)
+		kind, name = "DiscreteTag", device.DiscreteTagList[i].Name()
+	default:
+		i -= len(device.AnalogTagList) + len(device.DiscreteTagList)
+		kind, name = "TextTag", device.TextTagList[i].Name()
+	}
+	if name == "" {
+		return fmt.Sprintf("%s[%d]", kind, i)
+	}
+	return fmt.Sprintf("%s[%q]", kind, name)
+}
+
+// Clone returns a deep copy of the config.
+func (config EdgeConfig) Clone() EdgeConfig {
+	return EdgeConfig{Node: config.Node.Clone()}
+}
+
+// Clone returns a deep copy of the config.
+func (config NodeConfig) Clone() NodeConfig {
+	if config.DeviceList != nil {
+		devices := make([]DeviceConfig, len(config.DeviceList))
+		for i, device := range config.DeviceList {
+			devices[i] = device.Clone()
+		}
+		config.DeviceList = devices
+	}
+	return config
+}
+
+// Clone returns a deep copy of the config.
+func (config DeviceConfig) Clone() DeviceConfig {
+	if config.AnalogTagList != nil {
+		config.AnalogTagList = append([]AnalogTagConfig{}, config.AnalogTagList...)
+	}
+	if config.DiscreteTagList != nil {
+		config.DiscreteTagList = append([]DiscreteTagConfig{}, config.DiscreteTagList...)
+	}
+	if config.TextTagList != nil {
+		config.TextTagList = append([]TextTagConfig{}, config.TextTagList...)
+	}
+	return config
+}
+
+// Equal reports whether both configs have the same attributes, devices and
+// tags in the same order.
+func (config EdgeConfig) Equal(other EdgeConfig) bool {
+	return equalJSON(config, other)
+}
+
+// Equal ...
+func (config NodeConfig) Equal(other NodeConfig) bool {
+	return equalJSON(config, other)
+}
+
+// Equal ...
+func (config DeviceConfig) Equal(other DeviceConfig) bool {
+	return equalJSON(config, other)
+}
+
+// Equal ...
+func (config AnalogTagConfig) Equal(other AnalogTagConfig) bool {
+	return equalJSON(config, other)
+}
+
+// Equal ...
+func (config DiscreteTagConfig) Equal(other DiscreteTagConfig) bool {
+	return equalJSON(config, other)
+}
+
+// Equal ...
+func (config TextTagConfig) Equal(other TextTagConfig) bool {
+	return equalJSON(config, other)
+}
+
+func equalJSON(a interface{}, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+// The config types are encoded as in the JSON config file of LoadConfig.
+
+// MarshalJSON ...
+func (config EdgeConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(configFile{Node: config.Node.file()})
+}
+
+// UnmarshalJSON ...
+func (config *EdgeConfig) UnmarshalJSON(b []byte) error {
+	var doc configFile
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if errs := validateConfigFile(doc, noConfigFileLine); len(errs) > 0 {
+		return errs
+	}
+	*config = doc.edgeConfig()
+	return nil
+}
+
+// MarshalJSON ...
+func (config NodeConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(config.file())
+}
+
+// UnmarshalJSON ...
+func (config *NodeConfig) UnmarshalJSON(b []byte) error {
+	var doc configFile
+	if err := json.Unmarshal(b, &doc.Node); err != nil {
+		return err
+	}
+	if errs := validateConfigFile(doc, noConfigFileLine); len(errs) > 0 {
+		return errs
+	}
+	*config = doc.Node.nodeConfig()
+	return nil
+}
+
+// MarshalJSON ...
+func (config DeviceConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(config.file())
+}
+
+// UnmarshalJSON ...
+func (config *DeviceConfig) UnmarshalJSON(b []byte) error {
+	var doc configFile
+	doc.Node.Devices = make([]configFileDevice, 1)
+	if err := json.Unmarshal(b, &doc.Node.Devices[0]); err != nil {
+		return err
+	}
+	if errs := validateConfigFile(doc, noConfigFileLine); len(errs) > 0 {
+		return errs
+	}
+	*config = doc.Node.Devices[0].deviceConfig()
+	return nil
+}
+
+// MarshalJSON ...
+func (config AnalogTagConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(config.file())
+}
+
+// UnmarshalJSON ...
+func (config *AnalogTagConfig) UnmarshalJSON(b []byte) error {
+	tag, err := unmarshalTagConfig(b, "Analog")
+	if err != nil {
+		return err
+	}
+	*config = tag.analogTagConfig()
+	return nil
+}
+
+// MarshalJSON ...
+func (config DiscreteTagConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(config.file())
+}
+
+// UnmarshalJSON ...
+func (config *DiscreteTagConfig) UnmarshalJSON(b []byte) error {
+	tag, err := unmarshalTagConfig(b, "Discrete")
+	if err != nil {
+		return err
+	}
+	*config = tag.discreteTagConfig()
+	return nil
+}
+
+// MarshalJSON ...
+func (config TextTagConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(config.file())
+}
+
+// UnmarshalJSON ...
+func (config *TextTagConfig) UnmarshalJSON(b []byte) error {
+	tag, err := unmarshalTagConfig(b, "Text")
+	if err != nil {
+		return err
+	}
+	*config = tag.textTagConfig()
+	return nil
+}
+
+func noConfigFileLine(device int, tag int) int {
+	return 0
+}
+
+// unmarshalTagConfig decodes a tag of tagType, the type may be left out.
+func unmarshalTagConfig(b []byte, tagType string) (configFileTag, error) {
+	var tag configFileTag
+	if err := json.Unmarshal(b, &tag); err != nil {
+		return tag, err
+	}
+	if tag.Type == "" {
+		tag.Type = tagType
+	}
+	if tag.Type != tagType {
+		return tag, fmt.Errorf("%w: tag %q is %s, not %s", ErrInvalidConfig, tag.Name, tag.Type, tagType)
+	}
+	var errs ConfigFileErrors
+	if tag.Name == "" {
+		errs = append(errs, &ConfigFileError{Err: errors.New("tag: missing name")})
+	}
+	for _, err := range tag.validate() {
+		errs = append(errs, &ConfigFileError{Err: fmt.Errorf("tag %q: %v", tag.Name, err)})
+	}
+	if len(errs) > 0 {
+		return tag, errs
+	}
+	return tag, nil
+}
+
+func (config NodeConfig) file() configFileNode {
+	var n configFileNode
+	if t, ok := config.Type(); ok {
+		for name, value := range EdgeType {
+			if value == t {
+				nodeType := name
+				n.Type = &nodeType
+			}
+		}
+	}
+	n.PrimaryIP = stringPtr(config.PrimaryIP())
+	n.BackupIP = stringPtr(config.BackupIP())
+	n.PrimaryPort = intPtr(config.PrimaryPort())
+	n.BackupPort = intPtr(config.BackupPort())
+	for _, device := range config.DeviceList {
+		n.Devices = append(n.Devices, device.file())
+	}
+	return n
+}
+
+func (config DeviceConfig) file() configFileDevice {
+	d := configFileDevice{
+		ID:                  config.ID(),
+		Name:                stringPtr(config.Name()),
+		Type:                stringPtr(config.Type()),
+		Description:         stringPtr(config.Description()),
+		IP:                  stringPtr(config.IP()),
+		Port:                intPtr(config.Port()),
+		ComPortNumber:       intPtr(config.ComPortNumber()),
+		RetentionPolicyName: stringPtr(config.RetentionPolicyName()),
+	}
+	for _, tag := range config.AnalogTagList {
+		d.Tags = append(d.Tags, tag.file())
+	}
+	for _, tag := range config.DiscreteTagList {
+		d.Tags = append(d.Tags, tag.file())
+	}
+	for _, tag := range config.TextTagList {
+		d.Tags = append(d.Tags, tag.file())
+	}
+	return d
+}
+
+func (config AnalogTagConfig) file() configFileTag {
+	return configFileTag{
+		Name:                  config.Name(),
+		Type:                  "Analog",
+		Description:           stringPtr(config.Description()),
+		ReadOnly:              boolPtr(config.ReadOnly()),
+		ArraySize:             uintPtr(config.ArraySize()),
+		SpanHigh:              floatPtr(config.SpanHigh()),
+		SpanLow:               floatPtr(config.SpanLow()),
+		EngineerUnit:          stringPtr(config.EngineerUnit()),
+		IntegerDisplayFormat:  uintPtr(config.IntegerDisplayFormat()),
+		FractionDisplayFormat: uintPtr(config.FractionDisplayFormat()),
+	}
+}
+
+func (config DiscreteTagConfig) file() configFileTag {
+	return configFileTag{
+		Name:        config.Name(),
+		Type:        "Discrete",
+		Description: stringPtr(config.Description()),
+		ReadOnly:    boolPtr(config.ReadOnly()),
+		ArraySize:   uintPtr(config.ArraySize()),
+		State0:      stringPtr(config.State0()),
+		State1:      stringPtr(config.State1()),
+		State2:      stringPtr(config.State2()),
+		State3:      stringPtr(config.State3()),
+		State4:      stringPtr(config.State4()),
+		State5:      stringPtr(config.State5()),
+		State6:      stringPtr(config.State6()),
+		State7:      stringPtr(config.State7()),
+	}
+}
+
+func (config TextTagConfig) file() configFileTag {
+	return configFileTag{
+		Name:        config.Name(),
+		Type:        "Text",
+		Description: stringPtr(config.Description()),
+		ReadOnly:    boolPtr(config.ReadOnly()),
+		ArraySize:   uintPtr(config.ArraySize()),
+	}
+}
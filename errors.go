@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotConnected is returned when the agent is not connected to the broker.
+	ErrNotConnected = errors.New("agent is not connected")
+	// ErrInvalidConfig is returned when the config or action cannot be uploaded.
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrPublishFailed is matched by every PublishError.
+	ErrPublishFailed = errors.New("publish failed")
+	// ErrConfigRejected is returned when DataHub acks a config with Cfg=0.
+	ErrConfigRejected = errors.New("config rejected by DataHub")
+	// ErrConfigAckTimeout is returned when DataHub does not ack a config.
+	ErrConfigAckTimeout = errors.New("config ack timeout")
+	// ErrMessageTooLarge is wrapped by the TagValueError of a tag value which
+	// alone exceeds MaxMessageBytes.
+	ErrMessageTooLarge = errors.New("tag value exceeds the message size limit")
+	// ErrQueueFull is returned when the asynchronous SendData drops data.
+	ErrQueueFull = errors.New("send queue is full")
+	// ErrInvalidData is matched by the TagValueErrors of DataValidation.
+	ErrInvalidData = errors.New("invalid tag value")
+)
+
+// PublishError is returned when the broker did not accept a message.
+// errors.Is(err, ErrPublishFailed) reports true for it.
+type PublishError struct {
+	Topic string
+	Err   error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("publish to %s failed: %v", e.Topic, e.Err)
+}
+
+// Unwrap ...
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// Is ...
+func (e *PublishError) Is(target error) bool {
+	return target == ErrPublishFailed
+}
+
+// ConfigError is a problem of an EdgeConfig at Path,
+// e.g. Device[3].AnalogTag["Temp"].
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// Unwrap ...
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors is every problem found by EdgeConfig.Validate.
+// errors.Is(err, ErrInvalidConfig) reports true for it.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Is ...
+func (e ConfigErrors) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+// TagValueError is a tag value which was not sent, because it fails
+// DataValidation, cannot be encoded or exceeds MaxMessageBytes.
+type TagValueError struct {
+	DeviceID string
+	TagName  string
+	Err      error
+}
+
+func (e *TagValueError) Error() string {
+	return fmt.Sprintf("%s/%s: %v", e.DeviceID, e.TagName, e.Err)
+}
+
+// Unwrap ...
+func (e *TagValueError) Unwrap() error {
+	return e.Err
+}
+
+// TagValueErrors is returned by SendData when DataValidation["Drop"]
+// removed every tag value. errors.Is(err, ErrInvalidData) reports true for it.
+type TagValueErrors []*TagValueError
+
+func (e TagValueErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Is ...
+func (e TagValueErrors) Is(target error) bool {
+	return target == ErrInvalidData
+}
+
+// ConfigFileError is a problem found at a line of a config file.
+type ConfigFileError struct {
+	Line int
+	Err  error
+}
+
+func (e *ConfigFileError) Error() string {
+	if e.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Unwrap ...
+func (e *ConfigFileError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigFileErrors is every problem found in a config file.
+// errors.Is(err, ErrInvalidConfig) reports true for it.
+type ConfigFileErrors []*ConfigFileError
+
+func (e ConfigFileErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Is ...
+func (e ConfigFileErrors) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
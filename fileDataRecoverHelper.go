@@ -0,0 +1,447 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// journalSegmentMaxBytes ...
+	journalSegmentMaxBytes int64 = 4 << 20
+	// journalHeaderSize is length, crc, id and ts of a record
+	journalHeaderSize int64 = 24
+	// journalSegmentExt ...
+	journalSegmentExt string = ".seg"
+	// journalAckFile holds the last id of which every record is acknowledged
+	journalAckFile string = "ack"
+)
+
+type journalEntry struct {
+	id      int64
+	ts      int64
+	segment int64
+	offset  int64
+	size    int64
+}
+
+// fileDataRecoverHelper is an append-only journal of segment files.
+// Records are never rewritten: acknowledging moves the ack mark and
+// segments entirely below it are removed.
+type fileDataRecoverHelper struct {
+	lock       sync.Mutex
+	dir        string
+	fileMode   os.FileMode
+	dirMode    os.FileMode
+	limits     DataRecoverLimits
+	discard    discardCounter
+	logger     Logger
+	opened     bool
+	entries    []journalEntry // not acknowledged, in id order
+	bytes      int64
+	committed  int64
+	nextID     int64
+	segments   []int64 // first id of each segment file, sorted
+	active     *os.File
+	activeSize int64
+}
+
+// NewFileDataRecoverHelper returns a DataRecoverHelper storing the messages
+// in an append-only journal under dir. It is pure Go and does not need cgo.
+func NewFileDataRecoverHelper(dir string, limits DataRecoverLimits) DataRecoverHelper {
+	return newFileDataRecoverHelper(dir, limits, defaultLogger())
+}
+
+func newFileDataRecoverHelper(dir string, limits DataRecoverLimits, logger Logger) *fileDataRecoverHelper {
+	return &fileDataRecoverHelper{
+		dir:      dir,
+		fileMode: defaultFileMode,
+		dirMode:  defaultDirMode,
+		limits:   limits,
+		logger:   withFields(logger, "path", dir),
+	}
+}
+
+func segmentName(id int64) string {
+	return fmt.Sprintf("%020d%s", id, journalSegmentExt)
+}
+
+// open loads the journal on first use, the caller must hold the lock.
+func (helper *fileDataRecoverHelper) open() error {
+	if helper.opened {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(helper.dir, journalAckFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) > 0 {
+		if helper.committed, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err != nil {
+			return fmt.Errorf("invalid journal ack file: %w", err)
+		}
+	}
+
+	// the directory is created by the first append
+	files, err := ioutil.ReadDir(helper.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, journalSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, journalSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		helper.segments = append(helper.segments, id)
+	}
+	sort.Slice(helper.segments, func(i, j int) bool {
+		return helper.segments[i] < helper.segments[j]
+	})
+
+	helper.nextID = helper.committed + 1
+	for i, segment := range helper.segments {
+		last := i == len(helper.segments)-1
+		if err := helper.load(segment, last); err != nil {
+			return err
+		}
+	}
+	helper.opened = true
+	helper.removeSegments()
+	return nil
+}
+
+// load reads the records of a segment. A torn record at the end of the last
+// segment, left by a crash during Write, is truncated.
+func (helper *fileDataRecoverHelper) load(segment int64, last bool) error {
+	path := filepath.Join(helper.dir, segmentName(segment))
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	header := make([]byte, journalHeaderSize)
+	for {
+		if _, err = io.ReadFull(file, header); err != nil {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(header[0:4]))
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		id := int64(binary.LittleEndian.Uint64(header[8:16]))
+		ts := int64(binary.LittleEndian.Uint64(header[16:24]))
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(file, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			break
+		}
+		if crc32.ChecksumIEEE(append(header[8:24:24], payload...)) != sum {
+			err = errors.New("checksum mismatch")
+			break
+		}
+		if id > helper.committed {
+			helper.entries = append(helper.entries, journalEntry{
+				id:      id,
+				ts:      ts,
+				segment: segment,
+				offset:  offset + journalHeaderSize,
+				size:    size,
+			})
+			helper.bytes += size
+		}
+		if id >= helper.nextID {
+			helper.nextID = id + 1
+		}
+		offset += journalHeaderSize + size
+	}
+	if err == io.EOF {
+		return nil
+	}
+
+	helper.logger.Warn("journal segment is damaged", "segment", path, "offset", offset, "error", err)
+	if last {
+		return os.Truncate(path, offset)
+	}
+	return nil
+}
+
+func (helper *fileDataRecoverHelper) IsDataExist() bool {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	if err := helper.open(); err != nil {
+		helper.logger.Error("open journal failed", "error", err)
+		return false
+	}
+	helper.expire()
+	return len(helper.entries) > 0
+}
+
+func (helper *fileDataRecoverHelper) Read(count int) []string {
+	return readAcked(helper, count)
+}
+
+func (helper *fileDataRecoverHelper) Write(message string) bool {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	if err := helper.open(); err != nil {
+		helper.logger.Error("open journal failed", "error", err)
+		return false
+	}
+	helper.expire()
+
+	limits := &helper.limits
+	size := int64(len(message))
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		helper.discard.report(limits, helper.logger, "MaxBytes", 1, size)
+		return false
+	}
+	overRows := limits.MaxRows > 0 && len(helper.entries)+1 > limits.MaxRows
+	overBytes := limits.MaxBytes > 0 && helper.bytes+size > limits.MaxBytes
+	reason := "MaxRows"
+	if !overRows {
+		reason = "MaxBytes"
+	}
+	if (overRows || overBytes) && limits.DropPolicy == DropPolicy["DropNewest"] {
+		helper.discard.report(limits, helper.logger, reason, 1, size)
+		return false
+	}
+
+	if err := helper.append(message); err != nil {
+		helper.logger.Error("write journal failed", "error", err)
+		return false
+	}
+
+	count := 0
+	var bytes int64
+	for (limits.MaxRows > 0 && len(helper.entries) > limits.MaxRows) ||
+		(limits.MaxBytes > 0 && helper.bytes > limits.MaxBytes) {
+		count++
+		bytes += helper.entries[0].size
+		helper.bytes -= helper.entries[0].size
+		helper.entries = helper.entries[1:]
+	}
+	if count > 0 {
+		if err := helper.commit(); err != nil {
+			helper.logger.Error("write journal ack failed", "error", err)
+		}
+		helper.discard.report(limits, helper.logger, reason, count, bytes)
+	}
+	return true
+}
+
+// append writes a record to the active segment and syncs it, the caller
+// must hold the lock.
+func (helper *fileDataRecoverHelper) append(message string) error {
+	size := int64(len(message))
+	rotate := helper.active != nil && helper.activeSize > 0 && helper.activeSize+journalHeaderSize+size > journalSegmentMaxBytes
+	if rotate {
+		helper.active.Close()
+		helper.active = nil
+	}
+	if helper.active == nil {
+		segment := helper.nextID
+		if n := len(helper.segments); n > 0 && !rotate {
+			// keep appending to the last segment after a restart
+			if info, err := os.Stat(filepath.Join(helper.dir, segmentName(helper.segments[n-1]))); err == nil && info.Size()+journalHeaderSize+size <= journalSegmentMaxBytes {
+				segment = helper.segments[n-1]
+			}
+		}
+		if err := os.MkdirAll(helper.dir, helper.dirMode); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filepath.Join(helper.dir, segmentName(segment)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, helper.fileMode)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		helper.active = file
+		helper.activeSize = info.Size()
+		if n := len(helper.segments); n == 0 || helper.segments[n-1] != segment {
+			helper.segments = append(helper.segments, segment)
+		}
+	}
+
+	id := helper.nextID
+	ts := time.Now().UnixNano()
+	record := make([]byte, journalHeaderSize+size)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(size))
+	binary.LittleEndian.PutUint64(record[8:16], uint64(id))
+	binary.LittleEndian.PutUint64(record[16:24], uint64(ts))
+	copy(record[journalHeaderSize:], message)
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	if _, err := helper.active.Write(record); err != nil {
+		return err
+	}
+	if err := helper.active.Sync(); err != nil {
+		return err
+	}
+
+	helper.entries = append(helper.entries, journalEntry{
+		id:      id,
+		ts:      ts,
+		segment: helper.segments[len(helper.segments)-1],
+		offset:  helper.activeSize + journalHeaderSize,
+		size:    size,
+	})
+	helper.bytes += size
+	helper.activeSize += journalHeaderSize + size
+	helper.nextID++
+	return nil
+}
+
+func (helper *fileDataRecoverHelper) Peek(count int) ([]RecoverRecord, error) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	if err := helper.open(); err != nil {
+		helper.logger.Error("open journal failed", "error", err)
+		return nil, err
+	}
+	helper.expire()
+
+	var records []RecoverRecord
+	files := make(map[int64]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i := 0; i < count && i < len(helper.entries); i++ {
+		entry := helper.entries[i]
+		file, ok := files[entry.segment]
+		if !ok {
+			var err error
+			if file, err = os.Open(filepath.Join(helper.dir, segmentName(entry.segment))); err != nil {
+				helper.logger.Error("read journal failed", "error", err)
+				return nil, err
+			}
+			files[entry.segment] = file
+		}
+		payload := make([]byte, entry.size)
+		if _, err := file.ReadAt(payload, entry.offset); err != nil {
+			helper.logger.Error("read journal failed", "error", err)
+			return nil, err
+		}
+		records = append(records, RecoverRecord{
+			ID:      entry.id,
+			Message: string(payload),
+		})
+	}
+	return records, nil
+}
+
+func (helper *fileDataRecoverHelper) Ack(ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	if err := helper.open(); err != nil {
+		helper.logger.Error("open journal failed", "error", err)
+		return err
+	}
+
+	acked := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+	entries := helper.entries[:0]
+	for _, entry := range helper.entries {
+		if acked[entry.id] {
+			helper.bytes -= entry.size
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	helper.entries = entries
+	if err := helper.commit(); err != nil {
+		helper.logger.Error("write journal ack failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// commit persists the ack mark below the oldest pending record and removes
+// the segments below it, the caller must hold the lock. Records acknowledged
+// out of order stay above the mark and are replayed again after a restart.
+func (helper *fileDataRecoverHelper) commit() error {
+	committed := helper.nextID - 1
+	if len(helper.entries) > 0 {
+		committed = helper.entries[0].id - 1
+	}
+	if committed == helper.committed {
+		return nil
+	}
+	path := filepath.Join(helper.dir, journalAckFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(committed, 10)), helper.fileMode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	helper.committed = committed
+	helper.removeSegments()
+	return nil
+}
+
+// removeSegments deletes the segments of which every record is below the
+// ack mark, the caller must hold the lock.
+func (helper *fileDataRecoverHelper) removeSegments() {
+	for len(helper.segments) > 1 && helper.segments[1]-1 <= helper.committed {
+		path := filepath.Join(helper.dir, segmentName(helper.segments[0]))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			helper.logger.Error("remove journal segment failed", "segment", path, "error", err)
+			return
+		}
+		helper.segments = helper.segments[1:]
+	}
+	if len(helper.segments) == 1 && len(helper.entries) == 0 && helper.active == nil {
+		path := filepath.Join(helper.dir, segmentName(helper.segments[0]))
+		if err := os.Remove(path); err == nil || os.IsNotExist(err) {
+			helper.segments = nil
+		}
+	}
+}
+
+// expire drops the records older than MaxAge, the caller must hold the lock.
+func (helper *fileDataRecoverHelper) expire() {
+	if helper.limits.MaxAge <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-helper.limits.MaxAge).UnixNano()
+	count := 0
+	var bytes int64
+	for len(helper.entries) > 0 && helper.entries[0].ts < deadline {
+		count++
+		bytes += helper.entries[0].size
+		helper.bytes -= helper.entries[0].size
+		helper.entries = helper.entries[1:]
+	}
+	if count == 0 {
+		return
+	}
+	if err := helper.commit(); err != nil {
+		helper.logger.Error("write journal ack failed", "error", err)
+	}
+	helper.discard.report(&helper.limits, helper.logger, "MaxAge", count, bytes)
+}
@@ -0,0 +1,265 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestJournal(t *testing.T, dir string, limits DataRecoverLimits) *fileDataRecoverHelper {
+	t.Helper()
+	return newFileDataRecoverHelper(dir, limits, NewNopLogger())
+}
+
+// crash drops the helper the way a killed process would, without acking or
+// removing anything.
+func crash(helper *fileDataRecoverHelper) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	if helper.active != nil {
+		helper.active.Close()
+		helper.active = nil
+	}
+}
+
+func writeMessages(t *testing.T, helper *fileDataRecoverHelper, messages ...string) {
+	t.Helper()
+	for _, message := range messages {
+		if !helper.Write(message) {
+			t.Fatalf("Write(%q) failed", message)
+		}
+	}
+}
+
+func peekAll(t *testing.T, helper *fileDataRecoverHelper) ([]int64, []string) {
+	t.Helper()
+	records, err := helper.Peek(1 << 20)
+	if err != nil {
+		t.Fatalf("Peek: %v", err)
+	}
+	var ids []int64
+	var messages []string
+	for _, record := range records {
+		ids = append(ids, record.ID)
+		messages = append(messages, record.Message)
+	}
+	return ids, messages
+}
+
+func expectMessages(t *testing.T, helper *fileDataRecoverHelper, want ...string) []int64 {
+	t.Helper()
+	ids, messages := peekAll(t, helper)
+	if strings.Join(messages, ",") != strings.Join(want, ",") {
+		t.Fatalf("messages = %q, want %q", messages, want)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("ids not in order: %v", ids)
+		}
+	}
+	return ids
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+journalSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFileDataRecoverHelperRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	helper := newTestJournal(t, dir, DataRecoverLimits{})
+	writeMessages(t, helper, "m1", "m2", "m3", "m4", "m5")
+	ids := expectMessages(t, helper, "m1", "m2", "m3", "m4", "m5")
+	if err := helper.Ack(ids[:2]...); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	crash(helper)
+
+	helper = newTestJournal(t, dir, DataRecoverLimits{})
+	expectMessages(t, helper, "m3", "m4", "m5")
+	writeMessages(t, helper, "m6")
+	ids = expectMessages(t, helper, "m3", "m4", "m5", "m6")
+	if ids[3] <= ids[2] {
+		t.Fatalf("id after restart %d not above %d", ids[3], ids[2])
+	}
+	crash(helper)
+
+	helper = newTestJournal(t, dir, DataRecoverLimits{})
+	expectMessages(t, helper, "m3", "m4", "m5", "m6")
+	if got := helper.Read(10); strings.Join(got, ",") != "m3,m4,m5,m6" {
+		t.Fatalf("Read = %q", got)
+	}
+	if helper.IsDataExist() {
+		t.Fatal("IsDataExist after reading everything")
+	}
+	crash(helper)
+
+	helper = newTestJournal(t, dir, DataRecoverLimits{})
+	if helper.IsDataExist() {
+		t.Fatal("acknowledged records replayed after restart")
+	}
+}
+
+func TestFileDataRecoverHelperTornTail(t *testing.T) {
+	record := func(size uint32, payload string) []byte {
+		b := make([]byte, journalHeaderSize)
+		binary.LittleEndian.PutUint32(b[0:4], size)
+		binary.LittleEndian.PutUint64(b[8:16], 99)
+		return append(b, payload...)
+	}
+	tails := map[string][]byte{
+		"partial header":  record(10, "")[:10],
+		"partial payload": record(10, "12345"),
+		"bad checksum":    record(5, "12345"),
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			helper := newTestJournal(t, dir, DataRecoverLimits{})
+			writeMessages(t, helper, "m1", "m2", "m3")
+			crash(helper)
+
+			files := segmentFiles(t, dir)
+			if len(files) != 1 {
+				t.Fatalf("segments = %v, want 1", files)
+			}
+			info, err := os.Stat(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a write killed half way
+			f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tail)
+			f.Close()
+
+			helper = newTestJournal(t, dir, DataRecoverLimits{})
+			expectMessages(t, helper, "m1", "m2", "m3")
+			if truncated, _ := os.Stat(files[0]); truncated.Size() != info.Size() {
+				t.Fatalf("segment size = %d, want the torn record truncated to %d", truncated.Size(), info.Size())
+			}
+			writeMessages(t, helper, "m4")
+			crash(helper)
+
+			helper = newTestJournal(t, dir, DataRecoverLimits{})
+			expectMessages(t, helper, "m1", "m2", "m3", "m4")
+		})
+	}
+}
+
+func TestFileDataRecoverHelperAckOutOfOrder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	helper := newTestJournal(t, dir, DataRecoverLimits{})
+	writeMessages(t, helper, "m1", "m2", "m3")
+	ids := expectMessages(t, helper, "m1", "m2", "m3")
+	if err := helper.Ack(ids[1]); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	expectMessages(t, helper, "m1", "m3")
+	crash(helper)
+
+	// the ack mark stays below m1, m2 is replayed again rather than m1 lost
+	helper = newTestJournal(t, dir, DataRecoverLimits{})
+	expectMessages(t, helper, "m1", "m2", "m3")
+}
+
+func TestFileDataRecoverHelperSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	payload := strings.Repeat("x", int(journalSegmentMaxBytes/4))
+	var want []string
+	helper := newTestJournal(t, dir, DataRecoverLimits{})
+	for i := 0; i < 10; i++ {
+		message := fmt.Sprintf("%d%s", i, payload)
+		want = append(want, message)
+		writeMessages(t, helper, message)
+	}
+	if n := len(segmentFiles(t, dir)); n < 3 {
+		t.Fatalf("%d segments, want the journal rotated", n)
+	}
+	crash(helper)
+
+	helper = newTestJournal(t, dir, DataRecoverLimits{})
+	ids := expectMessages(t, helper, want...)
+	before := segmentFiles(t, dir)
+
+	// acking the records of the first segment removes it
+	first := before[0]
+	var acked []int64
+	for i, id := range ids {
+		if helper.entries[i].segment != helper.segments[0] {
+			break
+		}
+		acked = append(acked, id)
+	}
+	if err := helper.Ack(acked...); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Fatalf("acknowledged segment %s not removed: %v", first, err)
+	}
+	crash(helper)
+
+	helper = newTestJournal(t, dir, DataRecoverLimits{})
+	expectMessages(t, helper, want[len(acked):]...)
+	ids, _ = peekAll(t, helper)
+	if err := helper.Ack(ids...); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Fatalf("segments left after acking everything: %v", files)
+	}
+	crash(helper)
+
+	helper = newTestJournal(t, dir, DataRecoverLimits{})
+	if helper.IsDataExist() {
+		t.Fatal("acknowledged records replayed after restart")
+	}
+}
+
+func TestFileDataRecoverHelperLimitsRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	discarded := 0
+	limits := DataRecoverLimits{
+		MaxRows:   3,
+		OnDiscard: func(discard DataRecoverDiscard) { discarded += discard.Count },
+	}
+	helper := newTestJournal(t, dir, limits)
+	writeMessages(t, helper, "m1", "m2", "m3", "m4", "m5")
+	expectMessages(t, helper, "m3", "m4", "m5")
+	if discarded != 2 {
+		t.Fatalf("discarded %d, want 2", discarded)
+	}
+	crash(helper)
+
+	helper = newTestJournal(t, dir, limits)
+	expectMessages(t, helper, "m3", "m4", "m5")
+}
@@ -7,4 +7,5 @@ require (
 	github.com/google/uuid v1.1.1
 	github.com/mattn/go-sqlite3 v1.13.0
 	golang.org/x/net v0.0.0-20200425230154-ff2c4b7c35a0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Logger receives the log of the agent. keyvals are alternating keys and
+// values such as "nodeID", "n1", "topic", "/wisepaas/scada/n1/data".
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// LogLevel ...
+var LogLevel = map[string]byte{
+	"Debug": 0,
+	"Info":  1,
+	"Warn":  2,
+	"Error": 3,
+}
+
+var logLevelName = map[byte]string{
+	0: "DEBUG",
+	1: "INFO",
+	2: "WARN",
+	3: "ERROR",
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	level  byte
+}
+
+// NewStdLogger returns a Logger writing to a standard library logger,
+// messages below level are discarded.
+func NewStdLogger(logger *log.Logger, level byte) Logger {
+	return &stdLogger{
+		logger: logger,
+		level:  level,
+	}
+}
+
+func (l *stdLogger) Debug(msg string, keyvals ...interface{}) {
+	l.output(LogLevel["Debug"], msg, keyvals)
+}
+
+func (l *stdLogger) Info(msg string, keyvals ...interface{}) {
+	l.output(LogLevel["Info"], msg, keyvals)
+}
+
+func (l *stdLogger) Warn(msg string, keyvals ...interface{}) {
+	l.output(LogLevel["Warn"], msg, keyvals)
+}
+
+func (l *stdLogger) Error(msg string, keyvals ...interface{}) {
+	l.output(LogLevel["Error"], msg, keyvals)
+}
+
+func (l *stdLogger) output(level byte, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("[")
+	b.WriteString(logLevelName[level])
+	b.WriteString("] ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], value)
+	}
+	l.logger.Output(3, b.String())
+}
+
+type nopLogger struct{}
+
+// NewNopLogger returns a Logger discarding everything.
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// defaultLogger keeps the previous behaviour of printing to stdout.
+func defaultLogger() Logger {
+	return NewStdLogger(log.New(os.Stdout, "", log.LstdFlags), LogLevel["Info"])
+}
+
+type fieldLogger struct {
+	logger  Logger
+	keyvals []interface{}
+}
+
+// withFields returns a Logger adding keyvals to every message.
+func withFields(logger Logger, keyvals ...interface{}) Logger {
+	if l, ok := logger.(*fieldLogger); ok {
+		return &fieldLogger{
+			logger:  l.logger,
+			keyvals: append(append([]interface{}{}, l.keyvals...), keyvals...),
+		}
+	}
+	return &fieldLogger{
+		logger:  logger,
+		keyvals: keyvals,
+	}
+}
+
+func (l *fieldLogger) Debug(msg string, keyvals ...interface{}) {
+	l.logger.Debug(msg, append(append([]interface{}{}, l.keyvals...), keyvals...)...)
+}
+
+func (l *fieldLogger) Info(msg string, keyvals ...interface{}) {
+	l.logger.Info(msg, append(append([]interface{}{}, l.keyvals...), keyvals...)...)
+}
+
+func (l *fieldLogger) Warn(msg string, keyvals ...interface{}) {
+	l.logger.Warn(msg, append(append([]interface{}{}, l.keyvals...), keyvals...)...)
+}
+
+func (l *fieldLogger) Error(msg string, keyvals ...interface{}) {
+	l.logger.Error(msg, append(append([]interface{}{}, l.keyvals...), keyvals...)...)
+}
+
+type mqttLogger struct {
+	output func(msg string, keyvals ...interface{})
+}
+
+func (l mqttLogger) Println(v ...interface{}) {
+	l.output(strings.TrimSuffix(fmt.Sprintln(v...), "\n"), "component", "mqtt")
+}
+
+func (l mqttLogger) Printf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...), "component", "mqtt")
+}
+
+// SetMQTTLogger routes the DEBUG, WARN, ERROR and CRITICAL loggers of
+// paho.mqtt.golang to logger. They are package level in paho, so this
+// affects every agent in the process. A nil logger silences them again.
+func SetMQTTLogger(logger Logger) {
+	if logger == nil {
+		MQTT.DEBUG = MQTT.NOOPLogger{}
+		MQTT.WARN = MQTT.NOOPLogger{}
+		MQTT.ERROR = MQTT.NOOPLogger{}
+		MQTT.CRITICAL = MQTT.NOOPLogger{}
+		return
+	}
+	MQTT.DEBUG = mqttLogger{output: logger.Debug}
+	MQTT.WARN = mqttLogger{output: logger.Warn}
+	MQTT.ERROR = mqttLogger{output: logger.Error}
+	MQTT.CRITICAL = mqttLogger{output: logger.Error}
+}
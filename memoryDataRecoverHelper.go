@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryRecord struct {
+	RecoverRecord
+	ts time.Time
+}
+
+type memoryDataRecoverHelper struct {
+	lock    sync.Mutex
+	records []memoryRecord
+	bytes   int64
+	nextID  int64
+	limits  DataRecoverLimits
+	discard discardCounter
+	logger  Logger
+}
+
+// NewMemoryDataRecoverHelper returns a DataRecoverHelper keeping the
+// messages in memory, they are lost when the process exits. The oldest are
+// dropped to respect the limits, without MaxRows and MaxBytes it holds
+// defaultMemoryRecoverRows.
+func NewMemoryDataRecoverHelper(limits DataRecoverLimits) DataRecoverHelper {
+	return newMemoryDataRecoverHelper(limits, defaultLogger())
+}
+
+func newMemoryDataRecoverHelper(limits DataRecoverLimits, logger Logger) *memoryDataRecoverHelper {
+	if limits.MaxRows <= 0 && limits.MaxBytes <= 0 {
+		limits.MaxRows = defaultMemoryRecoverRows
+	}
+	return &memoryDataRecoverHelper{
+		nextID: 1,
+		limits: limits,
+		logger: withFields(logger, "recover", "memory"),
+	}
+}
+
+func (helper *memoryDataRecoverHelper) IsDataExist() bool {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.expire()
+	return len(helper.records) > 0
+}
+
+func (helper *memoryDataRecoverHelper) Read(count int) []string {
+	return readAcked(helper, count)
+}
+
+func (helper *memoryDataRecoverHelper) Write(message string) bool {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.expire()
+
+	limits := &helper.limits
+	size := int64(len(message))
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		helper.discard.report(limits, helper.logger, "MaxBytes", 1, size)
+		return false
+	}
+	overRows := limits.MaxRows > 0 && len(helper.records)+1 > limits.MaxRows
+	overBytes := limits.MaxBytes > 0 && helper.bytes+size > limits.MaxBytes
+	reason := "MaxRows"
+	if !overRows {
+		reason = "MaxBytes"
+	}
+	if (overRows || overBytes) && limits.DropPolicy == DropPolicy["DropNewest"] {
+		helper.discard.report(limits, helper.logger, reason, 1, size)
+		return false
+	}
+
+	count := 0
+	var bytes int64
+	for (limits.MaxRows > 0 && len(helper.records)+1 > limits.MaxRows) ||
+		(limits.MaxBytes > 0 && helper.bytes+size > limits.MaxBytes) {
+		count++
+		bytes += int64(len(helper.records[0].Message))
+		helper.removeFirst()
+	}
+	helper.discard.report(limits, helper.logger, reason, count, bytes)
+
+	helper.records = append(helper.records, memoryRecord{
+		RecoverRecord: RecoverRecord{
+			ID:      helper.nextID,
+			Message: message,
+		},
+		ts: time.Now(),
+	})
+	helper.nextID++
+	helper.bytes += size
+	return true
+}
+
+func (helper *memoryDataRecoverHelper) Peek(count int) ([]RecoverRecord, error) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.expire()
+	var records []RecoverRecord
+	for i := 0; i < count && i < len(helper.records); i++ {
+		records = append(records, helper.records[i].RecoverRecord)
+	}
+	return records, nil
+}
+
+func (helper *memoryDataRecoverHelper) Ack(ids ...int64) error {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	acked := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+	records := helper.records[:0]
+	for _, record := range helper.records {
+		if acked[record.ID] {
+			helper.bytes -= int64(len(record.Message))
+			continue
+		}
+		records = append(records, record)
+	}
+	for i := len(records); i < len(helper.records); i++ {
+		helper.records[i] = memoryRecord{}
+	}
+	helper.records = records
+	return nil
+}
+
+// removeFirst drops the oldest record, the caller must hold the lock. The
+// slice is resliced, append moves the records to a new array once the
+// capacity in front is used up.
+func (helper *memoryDataRecoverHelper) removeFirst() {
+	helper.bytes -= int64(len(helper.records[0].Message))
+	helper.records[0] = memoryRecord{}
+	helper.records = helper.records[1:]
+}
+
+// expire drops the records older than MaxAge, the caller must hold the lock.
+func (helper *memoryDataRecoverHelper) expire() {
+	if helper.limits.MaxAge <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-helper.limits.MaxAge)
+	count := 0
+	var bytes int64
+	for len(helper.records) > 0 && helper.records[0].ts.Before(deadline) {
+		count++
+		bytes += int64(len(helper.records[0].Message))
+		helper.removeFirst()
+	}
+	helper.discard.report(&helper.limits, helper.logger, "MaxAge", count, bytes)
+}
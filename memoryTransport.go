@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PublishedMessage is a message recorded by MemoryTransport.
+type PublishedMessage struct {
+	Topic    string
+	Payload  string
+	QoS      byte
+	Retained bool
+}
+
+// MemoryTransport is an in-memory Transport for tests. It never touches the
+// network: every published message is recorded, and messages can be
+// delivered to the agent's subscriptions with Deliver.
+type MemoryTransport struct {
+	lock          sync.Mutex
+	options       *TransportOptions
+	connected     bool
+	published     []PublishedMessage
+	subscriptions map[string]TransportMessageHandler
+	onPublish     func(PublishedMessage)
+	connectError  error
+	publishError  error
+}
+
+type memoryToken struct {
+	err error
+}
+
+func (t *memoryToken) Wait() bool                       { return true }
+func (t *memoryToken) WaitTimeout(d time.Duration) bool { return true }
+func (t *memoryToken) Error() error                     { return t.err }
+
+var errMemoryTransportNotConnected = errors.New("memory transport is not connected")
+
+// NewMemoryTransport ...
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		subscriptions: make(map[string]TransportMessageHandler),
+	}
+}
+
+// Connect connects at once, OnConnect is called on a new goroutine.
+func (t *MemoryTransport) Connect(options *TransportOptions) Token {
+	t.lock.Lock()
+	if t.connectError != nil {
+		err := t.connectError
+		t.lock.Unlock()
+		return &memoryToken{err: err}
+	}
+	t.options = options
+	t.connected = true
+	t.lock.Unlock()
+
+	// like paho, the connect handler runs on its own goroutine
+	if options.OnConnect != nil {
+		go options.OnConnect()
+	}
+	return &memoryToken{}
+}
+
+// IsConnected ...
+func (t *MemoryTransport) IsConnected() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.connected
+}
+
+// Publish records the message and delivers it to matching subscriptions.
+func (t *MemoryTransport) Publish(topic string, qos byte, retained bool, payload string) Token {
+	t.lock.Lock()
+	if !t.connected {
+		t.lock.Unlock()
+		return &memoryToken{err: errMemoryTransportNotConnected}
+	}
+	if t.publishError != nil {
+		err := t.publishError
+		t.lock.Unlock()
+		return &memoryToken{err: err}
+	}
+	msg := PublishedMessage{
+		Topic:    topic,
+		Payload:  payload,
+		QoS:      qos,
+		Retained: retained,
+	}
+	t.published = append(t.published, msg)
+	onPublish := t.onPublish
+	t.lock.Unlock()
+
+	if onPublish != nil {
+		onPublish(msg)
+	}
+	t.Deliver(topic, []byte(payload))
+	return &memoryToken{}
+}
+
+// Subscribe ...
+func (t *MemoryTransport) Subscribe(topic string, qos byte, handler TransportMessageHandler) Token {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.connected {
+		return &memoryToken{err: errMemoryTransportNotConnected}
+	}
+	t.subscriptions[topic] = handler
+	return &memoryToken{}
+}
+
+// Disconnect ...
+func (t *MemoryTransport) Disconnect(quiesce uint) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.connected = false
+	t.subscriptions = make(map[string]TransportMessageHandler)
+}
+
+// Deliver sends a message to every subscription whose filter matches topic,
+// as the broker would. It returns the number of handlers called.
+func (t *MemoryTransport) Deliver(topic string, payload []byte) int {
+	t.lock.Lock()
+	var handlers []TransportMessageHandler
+	for filter, handler := range t.subscriptions {
+		if matchTopic(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	t.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+	return len(handlers)
+}
+
+// SimulateConnectionLost drops the connection, records the will message
+// the broker would publish and fires the connection lost handler.
+func (t *MemoryTransport) SimulateConnectionLost(err error) {
+	t.lock.Lock()
+	if !t.connected {
+		t.lock.Unlock()
+		return
+	}
+	t.connected = false
+	t.subscriptions = make(map[string]TransportMessageHandler)
+	options := t.options
+	var will *PublishedMessage
+	if options.WillTopic != "" {
+		will = &PublishedMessage{
+			Topic:    options.WillTopic,
+			Payload:  options.WillPayload,
+			QoS:      options.WillQoS,
+			Retained: options.WillRetained,
+		}
+		t.published = append(t.published, *will)
+	}
+	onPublish := t.onPublish
+	t.lock.Unlock()
+
+	if will != nil && onPublish != nil {
+		onPublish(*will)
+	}
+	if options.OnConnectionLost != nil {
+		options.OnConnectionLost(err)
+	}
+}
+
+// SimulateReconnect restores a lost connection and fires the connect
+// handler on a new goroutine.
+func (t *MemoryTransport) SimulateReconnect() {
+	t.lock.Lock()
+	if t.connected || t.options == nil {
+		t.lock.Unlock()
+		return
+	}
+	t.connected = true
+	options := t.options
+	t.lock.Unlock()
+
+	if options.OnConnect != nil {
+		go options.OnConnect()
+	}
+}
+
+// SetConnectError makes subsequent Connect calls fail with err.
+func (t *MemoryTransport) SetConnectError(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.connectError = err
+}
+
+// SetPublishError makes subsequent Publish calls fail with err.
+func (t *MemoryTransport) SetPublishError(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.publishError = err
+}
+
+// OnPublish registers a function called for every recorded message.
+func (t *MemoryTransport) OnPublish(handler func(PublishedMessage)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.onPublish = handler
+}
+
+// Options returns the options passed to the last Connect.
+func (t *MemoryTransport) Options() *TransportOptions {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.options
+}
+
+// Published returns a copy of every recorded message in publish order.
+func (t *MemoryTransport) Published() []PublishedMessage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	messages := make([]PublishedMessage, len(t.published))
+	copy(messages, t.published)
+	return messages
+}
+
+// PublishedTo returns the recorded messages sent to topic.
+func (t *MemoryTransport) PublishedTo(topic string) []PublishedMessage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var messages []PublishedMessage
+	for _, msg := range t.published {
+		if msg.Topic == topic {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// Subscriptions returns the topic filters currently subscribed.
+func (t *MemoryTransport) Subscriptions() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var topics []string
+	for topic := range t.subscriptions {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Reset clears the recorded messages.
+func (t *MemoryTransport) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.published = nil
+}
+
+// matchTopic reports whether topic matches the MQTT filter, supporting the
+// "+" and "#" wildcards.
+func matchTopic(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
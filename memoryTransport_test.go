@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitSignal(t *testing.T, c chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s not called", what)
+	}
+}
+
+func TestMemoryTransportConnectHandlerAsync(t *testing.T) {
+	transport := NewMemoryTransport()
+	release := make(chan struct{})
+	called := make(chan struct{})
+	options := &TransportOptions{OnConnect: func() {
+		<-release
+		close(called)
+	}}
+
+	returned := make(chan Token)
+	go func() {
+		returned <- transport.Connect(options)
+	}()
+	select {
+	case token := <-returned:
+		if token.Error() != nil {
+			t.Fatalf("Connect: %v", token.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect waits for the OnConnect handler")
+	}
+	if !transport.IsConnected() {
+		t.Fatal("not connected after Connect")
+	}
+	close(release)
+	waitSignal(t, called, "OnConnect")
+}
+
+func TestMemoryTransportPublishDeliver(t *testing.T) {
+	transport := NewMemoryTransport()
+	transport.Connect(&TransportOptions{})
+
+	var received []string
+	for _, filter := range []string{"a/+/c", "a/#", "x/y"} {
+		filter := filter
+		transport.Subscribe(filter, 1, func(topic string, payload []byte) {
+			received = append(received, filter+" "+topic+" "+string(payload))
+		})
+	}
+	var recorded []PublishedMessage
+	transport.OnPublish(func(msg PublishedMessage) {
+		recorded = append(recorded, msg)
+	})
+
+	if err := transport.Publish("a/b/c", 1, true, "1").Error(); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	transport.Publish("x/y", 0, false, "2")
+	transport.Publish("other", 0, false, "3")
+
+	sort.Strings(received)
+	want := []string{"a/# a/b/c 1", "a/+/c a/b/c 1", "x/y x/y 2"}
+	if strings.Join(received, ",") != strings.Join(want, ",") {
+		t.Fatalf("received %q, want %q", received, want)
+	}
+	if len(recorded) != 3 || len(transport.Published()) != 3 {
+		t.Fatalf("recorded %d and %d messages, want 3", len(recorded), len(transport.Published()))
+	}
+	if msgs := transport.PublishedTo("a/b/c"); len(msgs) != 1 || msgs[0].QoS != 1 || !msgs[0].Retained {
+		t.Fatalf("PublishedTo = %+v", msgs)
+	}
+	if n := transport.Deliver("a/z/c", []byte("4")); n != 2 {
+		t.Fatalf("Deliver reached %d handlers, want 2", n)
+	}
+	transport.Reset()
+	if len(transport.Published()) != 0 {
+		t.Fatal("Reset kept the messages")
+	}
+
+	transport.Disconnect(0)
+	if transport.IsConnected() || len(transport.Subscriptions()) != 0 {
+		t.Fatal("Disconnect kept the connection or the subscriptions")
+	}
+	if err := transport.Publish("a/b/c", 1, false, "5").Error(); err == nil {
+		t.Fatal("Publish succeeded while disconnected")
+	}
+}
+
+func TestMemoryTransportErrors(t *testing.T) {
+	transport := NewMemoryTransport()
+	connectErr := errors.New("refused")
+	transport.SetConnectError(connectErr)
+	if err := transport.Connect(&TransportOptions{}).Error(); err != connectErr {
+		t.Fatalf("Connect = %v, want %v", err, connectErr)
+	}
+	if transport.IsConnected() {
+		t.Fatal("connected despite the connect error")
+	}
+
+	transport.SetConnectError(nil)
+	transport.Connect(&TransportOptions{})
+	publishErr := errors.New("no ack")
+	transport.SetPublishError(publishErr)
+	if err := transport.Publish("t", 1, false, "p").Error(); err != publishErr {
+		t.Fatalf("Publish = %v, want %v", err, publishErr)
+	}
+	if len(transport.Published()) != 0 {
+		t.Fatal("failed publish was recorded")
+	}
+}
+
+func TestMemoryTransportConnectionLost(t *testing.T) {
+	transport := NewMemoryTransport()
+	connected := make(chan struct{}, 2)
+	lost := make(chan struct{}, 1)
+	options := &TransportOptions{
+		WillTopic:        "will",
+		WillPayload:      "gone",
+		WillQoS:          1,
+		WillRetained:     true,
+		OnConnect:        func() { connected <- struct{}{} },
+		OnConnectionLost: func(err error) { lost <- struct{}{} },
+	}
+	transport.Connect(options)
+	waitSignal(t, connected, "OnConnect")
+	transport.Subscribe("t", 1, func(string, []byte) {})
+
+	transport.SimulateConnectionLost(errors.New("timeout"))
+	waitSignal(t, lost, "OnConnectionLost")
+	if transport.IsConnected() || len(transport.Subscriptions()) != 0 {
+		t.Fatal("connection or subscriptions kept after the connection was lost")
+	}
+	if msgs := transport.PublishedTo("will"); len(msgs) != 1 || msgs[0].Payload != "gone" {
+		t.Fatalf("will messages = %+v", msgs)
+	}
+
+	transport.SimulateReconnect()
+	waitSignal(t, connected, "OnConnect after reconnect")
+	if !transport.IsConnected() {
+		t.Fatal("not connected after SimulateReconnect")
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"#", "a", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, test := range tests {
+		if got := matchTopic(test.filter, test.topic); got != test.match {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", test.filter, test.topic, got, test.match)
+		}
+	}
+}
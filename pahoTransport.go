@@ -0,0 +1,70 @@
+package agent
+
+import (
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+type pahoTransport struct {
+	client MQTT.Client
+}
+
+// NewPahoTransport returns the default Transport backed by paho.mqtt.golang.
+func NewPahoTransport() Transport {
+	return &pahoTransport{}
+}
+
+func (t *pahoTransport) Connect(options *TransportOptions) Token {
+	clientOptions := MQTT.NewClientOptions()
+	clientOptions.AddBroker(options.Broker)
+	clientOptions.SetClientID(options.ClientID)
+	clientOptions.SetAutoReconnect(true)
+	clientOptions.SetConnectRetry(true)
+	clientOptions.SetConnectRetryInterval(options.ReconnectInterval)
+	clientOptions.SetCleanSession(options.CleanSession)
+	clientOptions.SetPassword(options.Password)
+	clientOptions.SetUsername(options.UserName)
+	clientOptions.SetMaxReconnectInterval(options.ReconnectInterval)
+	if options.TLSConfig != nil {
+		clientOptions.SetTLSConfig(options.TLSConfig)
+	}
+	if options.WillTopic != "" {
+		clientOptions.SetWill(options.WillTopic, options.WillPayload, options.WillQoS, options.WillRetained)
+	}
+	clientOptions.SetOnConnectHandler(func(c MQTT.Client) {
+		if options.OnConnect != nil {
+			options.OnConnect()
+		}
+	})
+	clientOptions.SetConnectionLostHandler(func(c MQTT.Client, err error) {
+		if options.OnConnectionLost != nil {
+			options.OnConnectionLost(err)
+		}
+	})
+
+	t.client = MQTT.NewClient(clientOptions)
+	return t.client.Connect()
+}
+
+func (t *pahoTransport) IsConnected() bool {
+	if t.client == nil {
+		return false
+	}
+	return t.client.IsConnectionOpen()
+}
+
+func (t *pahoTransport) Publish(topic string, qos byte, retained bool, payload string) Token {
+	return t.client.Publish(topic, qos, retained, payload)
+}
+
+func (t *pahoTransport) Subscribe(topic string, qos byte, handler TransportMessageHandler) Token {
+	return t.client.Subscribe(topic, qos, func(c MQTT.Client, msg MQTT.Message) {
+		handler(msg.Topic(), msg.Payload())
+	})
+}
+
+func (t *pahoTransport) Disconnect(quiesce uint) {
+	if t.client == nil {
+		return
+	}
+	t.client.Disconnect(quiesce)
+}
@@ -0,0 +1,161 @@
+package agent_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	agent "github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK"
+	"github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK/datahubtest"
+)
+
+// connect connects edgeAgent and waits for the OnConnect handler, which
+// runs after the subscriptions are made.
+func connect(t *testing.T, edgeAgent agent.Agent) {
+	t.Helper()
+	connected := make(chan struct{}, 1)
+	edgeAgent.SetOnConnectHandler(func(agent.Agent) {
+		connected <- struct{}{}
+	})
+	if err := edgeAgent.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnConnect not called")
+	}
+}
+
+// TestFileDataRecoverReplay spools data while the broker refuses it, kills
+// the agent in the middle of a journal write and checks that a new agent
+// replays everything in order.
+func TestFileDataRecoverReplay(t *testing.T) {
+	server := datahubtest.NewServer()
+	defer server.Close()
+
+	newAgent := func() (agent.Agent, *agent.MemoryTransport) {
+		options := server.AgentOptions("node1")
+		options.Logger = agent.NewNopLogger()
+		options.DataRecover = true
+		options.DataRecoverType = agent.DataRecoverType["File"]
+		edgeAgent := agent.NewAgent(options)
+		connect(t, edgeAgent)
+		return edgeAgent, options.Transport.(*agent.MemoryTransport)
+	}
+
+	edgeAgent, transport := newAgent()
+	transport.SetPublishError(errors.New("broker unavailable"))
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		data := agent.EdgeData{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			TagList:   []agent.EdgeTag{{DeviceID: "Device1", TagName: "ATag1", Value: i}},
+		}
+		if result, _ := edgeAgent.SendDataE(data); result.Spooled != 1 {
+			t.Fatalf("SendData %d = %+v, want spooled", i, result)
+		}
+	}
+	transport.SimulateConnectionLost(errors.New("killed"))
+
+	segments, err := filepath.Glob(filepath.Join(server.StateDir(), "node1", "recover.journal", "*.seg"))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("journal segments = %v, %v", segments, err)
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{10, 0, 0, 0, 1, 2, 3})
+	f.Close()
+
+	edgeAgent, _ = newAgent()
+	defer edgeAgent.Disconnect()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(server.Data("node1")) < 5 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	messages := server.Data("node1")
+	if len(messages) != 5 {
+		t.Fatalf("replayed %d messages, want 5", len(messages))
+	}
+	for i, message := range messages {
+		if !message.Timestamp.Equal(start.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("message %d has timestamp %v, replay out of order", i, message.Timestamp)
+		}
+		if value := message.Values["Device1"]["ATag1"]; value != float64(i) {
+			t.Fatalf("message %d has value %v, want %d", i, value, i)
+		}
+	}
+}
+
+// readOnlyHelper is a custom DataRecoverHelper without Peek and Ack.
+type readOnlyHelper struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (helper *readOnlyHelper) IsDataExist() bool {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	return len(helper.messages) > 0
+}
+
+func (helper *readOnlyHelper) Read(count int) []string {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	if count > len(helper.messages) {
+		count = len(helper.messages)
+	}
+	messages := helper.messages[:count]
+	helper.messages = helper.messages[count:]
+	return messages
+}
+
+func (helper *readOnlyHelper) Write(message string) bool {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.messages = append(helper.messages, message)
+	return true
+}
+
+func TestCustomDataRecoverReplay(t *testing.T) {
+	server := datahubtest.NewServer()
+	defer server.Close()
+
+	helper := &readOnlyHelper{}
+	options := server.AgentOptions("node1")
+	options.Logger = agent.NewNopLogger()
+	options.DataRecover = true
+	options.DataRecoverHelper = helper
+	edgeAgent := agent.NewAgent(options)
+	connect(t, edgeAgent)
+	defer edgeAgent.Disconnect()
+	transport := options.Transport.(*agent.MemoryTransport)
+
+	transport.SetPublishError(errors.New("broker unavailable"))
+	for i := 0; i < 3; i++ {
+		data := agent.EdgeData{
+			Timestamp: time.Now(),
+			TagList:   []agent.EdgeTag{{DeviceID: "Device1", TagName: "ATag1", Value: i}},
+		}
+		if result, _ := edgeAgent.SendDataE(data); result.Spooled != 1 {
+			t.Fatalf("SendData %d = %+v, want spooled", i, result)
+		}
+	}
+	transport.SetPublishError(nil)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(server.Data("node1")) < 3 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := len(server.Data("node1")); n != 3 {
+		t.Fatalf("replayed %d messages, want 3", n)
+	}
+	if helper.IsDataExist() {
+		t.Fatal("replayed messages left in the helper")
+	}
+}
@@ -0,0 +1,66 @@
+package agent_test
+
+import (
+	"context"
+	"testing"
+
+	agent "github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK"
+	"github.com/advwacloud/WISEPaaS.DataHub.Edge.Go.SDK/datahubtest"
+)
+
+func syncTestConfig(description string, spanHigh float64) agent.EdgeConfig {
+	config := agent.EdgeConfig{Node: agent.NewNodeConfig()}
+	config.Node.SetType(agent.EdgeType["Gateway"])
+	device := agent.NewDeviceConfig("Device1")
+	device.SetName("Device 1")
+	device.SetType("Smart Device")
+	if description != "" {
+		device.SetDescription(description)
+	}
+	analog := agent.NewAnaglogTagConfig("ATag1")
+	analog.SetSpanHigh(spanHigh)
+	device.AnalogTagList = append(device.AnalogTagList, analog)
+	config.Node.DeviceList = append(config.Node.DeviceList, device)
+	return config
+}
+
+func TestSyncConfig(t *testing.T) {
+	server := datahubtest.NewServer()
+	defer server.Close()
+
+	options := server.AgentOptions("node1")
+	options.Logger = agent.NewNopLogger()
+	edgeAgent := agent.NewAgent(options)
+	connect(t, edgeAgent)
+	defer edgeAgent.Disconnect()
+
+	ctx := context.Background()
+	if err := edgeAgent.UploadConfigAndWait(ctx, agent.Action["Create"], syncTestConfig("boiler", 100)); err != nil {
+		t.Fatalf("UploadConfigAndWait: %v", err)
+	}
+	uploads := len(server.Configs("node1"))
+
+	// the description is left out, DataHub and the cache keep it
+	desired := syncTestConfig("", 200)
+	diff, err := edgeAgent.SyncConfig(ctx, desired, true)
+	if err != nil || len(diff.Changes) != 1 || diff.Changes[0].Action != agent.Action["Update"] {
+		t.Fatalf("dry run = %v, %v, want one Update", diff.Changes, err)
+	}
+	if n := len(server.Configs("node1")); n != uploads {
+		t.Fatalf("dry run uploaded %d configs", n-uploads)
+	}
+
+	if _, err := edgeAgent.SyncConfig(ctx, desired, false); err != nil {
+		t.Fatalf("SyncConfig: %v", err)
+	}
+	configs := server.Configs("node1")
+	if len(configs) != uploads+1 || configs[uploads].Action != agent.Action["Update"] {
+		t.Fatalf("configs = %+v, want one more Update", configs)
+	}
+	if diff, _ := edgeAgent.DiffConfig(desired); !diff.IsEmpty() {
+		t.Fatalf("diff after sync = %v", diff.Changes)
+	}
+	if diff, _ := edgeAgent.DiffConfig(syncTestConfig("boiler", 200)); !diff.IsEmpty() {
+		t.Fatalf("description lost from the cache: %v", diff.Changes)
+	}
+}
@@ -1,18 +1,31 @@
 package agent
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"os"
-
-	_ "github.com/mattn/go-sqlite3"
+	"strings"
 )
 
 type tagsCfgHelper interface {
 	addCfgToMemory(a *agent, config configMessage) bool
 	getCfgFromFile(a *agent, filePath string) bool
 	addCfgToFile(a *agent, filePath string) bool
+	getFingerprintFromFile(a *agent, filePath string) bool
+	addFingerprintToFile(a *agent, filePath string, fingerprint string) bool
+}
+
+// configFingerprint is a stable hash of an upload. Maps are encoded with
+// sorted keys, so the same action and config always give the same hash.
+func configFingerprint(config configMessage) string {
+	j, err := json.Marshal(config.D)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:])
 }
 
 type tagsCfgStruct struct{}
@@ -21,11 +34,99 @@ func newTagsCfgHelper() tagsCfgHelper {
 	return &tagsCfgStruct{}
 }
 
+// addCfgToMemory applies config to the cache the way DataHub applies it:
+// Create and Update merge nodes, devices and tags, Delsert replaces the node
+// and Delete removes the node, the devices or the tags given.
 func (helper *tagsCfgStruct) addCfgToMemory(a *agent, config configMessage) bool {
-	a.cfgCache = config
+	a.cfgLock.Lock()
+	defer a.cfgLock.Unlock()
+	if a.cfgCache.D.Scada == nil {
+		a.cfgCache = newConfigData(Action["Create"])
+	}
+	a.cfgCache.Ts = config.Ts
+	for nodeID, node := range config.D.Scada {
+		mergeNodeConfig(a.cfgCache.D.Scada, nodeID, config.D.Action, normalizeConfig(node))
+	}
 	return true
 }
 
+func mergeNodeConfig(scada map[string]interface{}, nodeID string, action byte, node map[string]interface{}) {
+	cached, ok := scada[nodeID].(map[string]interface{})
+	if action == Action["Delete"] {
+		if ok {
+			deleteNodeConfig(scada, nodeID, cached, node)
+		}
+		return
+	}
+	if !ok || action == Action["Delsert"] {
+		scada[nodeID] = node
+		return
+	}
+
+	mergeAttributes(cached, node, "Device")
+	devices := childMap(node, "Device")
+	if len(devices) == 0 {
+		return
+	}
+	cachedDevices := childMap(cached, "Device")
+	cached["Device"] = cachedDevices
+	for deviceID := range devices {
+		device := childMap(devices, deviceID)
+		cachedDevice, ok := cachedDevices[deviceID].(map[string]interface{})
+		if !ok {
+			cachedDevices[deviceID] = device
+			continue
+		}
+
+		mergeAttributes(cachedDevice, device, "Tag")
+		tags := childMap(device, "Tag")
+		if len(tags) == 0 {
+			continue
+		}
+		cachedTags := childMap(cachedDevice, "Tag")
+		cachedDevice["Tag"] = cachedTags
+		for tagName := range tags {
+			tag := childMap(tags, tagName)
+			cachedTag, ok := cachedTags[tagName].(map[string]interface{})
+			if !ok || action == Action["Create"] {
+				cachedTags[tagName] = tag
+				continue
+			}
+			mergeAttributes(cachedTag, tag, "")
+		}
+	}
+}
+
+// deleteNodeConfig removes the whole node when no device is given, a device
+// when it has no tags and otherwise only its tags.
+func deleteNodeConfig(scada map[string]interface{}, nodeID string, cached map[string]interface{}, node map[string]interface{}) {
+	devices, ok := node["Device"].(map[string]interface{})
+	if !ok {
+		delete(scada, nodeID)
+		return
+	}
+	cachedDevices := childMap(cached, "Device")
+	for deviceID := range devices {
+		tags, ok := childMap(devices, deviceID)["Tag"].(map[string]interface{})
+		if !ok {
+			delete(cachedDevices, deviceID)
+			continue
+		}
+		cachedTags := childMap(childMap(cachedDevices, deviceID), "Tag")
+		for tagName := range tags {
+			delete(cachedTags, tagName)
+		}
+	}
+}
+
+func mergeAttributes(cached map[string]interface{}, config map[string]interface{}, skip string) {
+	for key, value := range config {
+		if key != skip {
+			cached[key] = value
+		}
+	}
+}
+
 func (helper *tagsCfgStruct) getCfgFromFile(a *agent, filePath string) bool {
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return false
@@ -33,29 +134,68 @@ func (helper *tagsCfgStruct) getCfgFromFile(a *agent, filePath string) bool {
 
 	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		fmt.Printf("%s", err.Error())
+		a.logger.Error("read config cache failed", "path", filePath, "error", err)
 		return false
 	}
 
 	if err := json.Unmarshal([]byte(content), &a.cfgCache); err != nil {
-		fmt.Printf("%s", err.Error())
+		a.logger.Error("decode config cache failed", "path", filePath, "error", err)
 		return false
 	}
 
 	return true
 }
 
+func (helper *tagsCfgStruct) getFingerprintFromFile(a *agent, filePath string) bool {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			a.logger.Error("read config fingerprint failed", "path", filePath, "error", err)
+		}
+		return false
+	}
+
+	a.cfgLock.Lock()
+	a.cfgFingerprint = strings.TrimSpace(string(content))
+	a.cfgLock.Unlock()
+	return true
+}
+
+// addFingerprintToFile stores the fingerprint of the last acknowledged
+// config, an empty fingerprint removes it.
+func (helper *tagsCfgStruct) addFingerprintToFile(a *agent, filePath string, fingerprint string) bool {
+	a.cfgLock.Lock()
+	a.cfgFingerprint = fingerprint
+	a.cfgLock.Unlock()
+
+	if fingerprint == "" {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			a.logger.Error("remove config fingerprint failed", "path", filePath, "error", err)
+			return false
+		}
+		return true
+	}
+
+	if err := a.writeStateFile(filePath, []byte(fingerprint)); err != nil {
+		a.logger.Error("write config fingerprint failed", "path", filePath, "error", err)
+		return false
+	}
+	return true
+}
+
 func (helper *tagsCfgStruct) addCfgToFile(a *agent, filePath string) bool {
+	a.cfgLock.RLock()
 	jsonStr, err := json.Marshal(a.cfgCache)
+	a.cfgLock.RUnlock()
 
 	if err != nil {
-		fmt.Printf("%s", err.Error())
+		a.logger.Error("encode config cache failed", "error", err)
 		return false
 	}
 
-	err = ioutil.WriteFile(filePath, []byte(jsonStr), 0644)
+	err = a.writeStateFile(filePath, jsonStr)
 	if err != nil {
-		fmt.Printf("%s", err.Error())
+		a.logger.Error("write config cache failed", "path", filePath, "error", err)
 		return false
 	}
 
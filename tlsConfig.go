@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// tlsConfig builds a new *tls.Config from the options.
+func (o *TLSOptions) tlsConfig() (*tls.Config, error) {
+	if o.Config != nil {
+		return o.Config.Clone(), nil
+	}
+
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		MinVersion:         o.MinVersion,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	caPEM := o.CAPEM
+	if o.CAFile != "" {
+		content, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file failed: %w", err)
+		}
+		caPEM = append(append([]byte{}, caPEM...), content...)
+	}
+	if len(caPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no valid certificate found in CA bundle")
+		}
+		config.RootCAs = pool
+	}
+
+	certPEM, keyPEM := o.CertPEM, o.KeyPEM
+	if o.CertFile != "" || o.KeyFile != "" {
+		var err error
+		if certPEM, err = ioutil.ReadFile(o.CertFile); err != nil {
+			return nil, fmt.Errorf("read client certificate failed: %w", err)
+		}
+		if keyPEM, err = ioutil.ReadFile(o.KeyFile); err != nil {
+			return nil, fmt.Errorf("read client key failed: %w", err)
+		}
+	}
+	if len(certPEM) > 0 || len(keyPEM) > 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate failed: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
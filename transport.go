@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Transport is the connection used by the agent to talk to the broker.
+// The default implementation is backed by paho, see NewPahoTransport.
+type Transport interface {
+	Connect(options *TransportOptions) Token
+	IsConnected() bool
+	Publish(topic string, qos byte, retained bool, payload string) Token
+	Subscribe(topic string, qos byte, handler TransportMessageHandler) Token
+	Disconnect(quiesce uint)
+}
+
+// Token is returned by asynchronous Transport operations.
+// It has the same method set as the paho token.
+type Token interface {
+	Wait() bool
+	WaitTimeout(time.Duration) bool
+	Error() error
+}
+
+// TransportMessageHandler ...
+type TransportMessageHandler func(topic string, payload []byte)
+
+// TransportOptions is built by the agent on every Connect.
+type TransportOptions struct {
+	Broker            string // e.g. tcp://127.0.0.1:1883
+	ClientID          string
+	UserName          string
+	Password          string
+	CleanSession      bool
+	ReconnectInterval time.Duration
+	WillTopic         string
+	WillPayload       string
+	WillQoS           byte
+	WillRetained      bool
+	TLSConfig         *tls.Config // nil for plain tcp and ws
+	OnConnect         func()
+	OnConnectionLost  func(err error)
+}
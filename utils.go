@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 )
@@ -33,3 +34,23 @@ func setInterval(someFunc func(), seconds int, async bool) chan bool {
 	}()
 	return clear
 }
+
+// waitToken waits for token until ctx is done. When ctx is done first the
+// token is left to complete in the background and ctx.Err() is returned.
+func waitToken(ctx context.Context, token Token) error {
+	if ctx.Done() == nil {
+		token.Wait()
+		return token.Error()
+	}
+	done := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}